@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"sort"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/multiversecoder/hidemego/linux"
+)
+
+// attempt aggregates the blocked packets of a program to a destination
+type attempt struct {
+	UID int `json:"uid"`
+	// User is the name of UID, empty when unknown
+	User string `json:"user,omitempty"`
+	// Process is the command name, known only while listening to NFLOG
+	Process     string    `json:"process,omitempty"`
+	Proto       string    `json:"proto"`
+	Destination string    `json:"destination"`
+	Count       int       `json:"count"`
+	First       time.Time `json:"first"`
+	Last        time.Time `json:"last"`
+}
+
+func init() {
+	register(&command{
+		Name:  "audit",
+		Short: "Show the programs whose traffic the firewall blocked",
+		Long: `
+Reads the packets dropped by the hidemego firewall and aggregates them by user,
+process and destination, to find the programs trying to leak outside Tor.
+The session must log them with firewall.log_dropped (-log-dropped on start).
+
+With log_dropped = "kernel" the packets are read from the kernel log since
+-since. With log_dropped = "nflog" the command listens to the NFLOG group,
+prints every blocked packet with the process owning its socket, and shows the
+summary after -duration or when interrupted. The packets of the udp log
+policy are included when udp.nflog_group is the same group. No other program,
+e.g. ulogd, can listen to the group meanwhile.
+
+The rate of the logged packets is limited by firewall.log_rate, so the counts
+are a lower bound.`,
+		Examples: []string{
+			"hidemego audit",
+			"hidemego audit -since=24h",
+			"hidemego audit -source=nflog -duration=5m",
+			"hidemego audit -json"},
+		Root: true,
+		Flags: func(fs *flag.FlagSet) {
+			fs.String("source", "", "kernel or nflog (default: the session firewall.log_dropped)")
+			fs.Duration("since", time.Hour, "Age of the oldest kernel log entry read")
+			fs.Duration("duration", 0, "Time spent listening to NFLOG, 0 listens until interrupted")
+			fs.Int("group", -1, "NFLOG group (default: the session firewall.log_group)")
+			fs.Bool("json", false, "Print the summary as JSON")
+		},
+		Run: runAudit})
+}
+
+func runAudit(fs *flag.FlagSet) int {
+	cfg, err := loadSession()
+	if err != nil {
+		logger.Println("Can't Load Hidemego Session:", err)
+		return exitFailure
+	}
+	source := fs.Lookup("source").Value.String()
+	if source == "" {
+		source = "kernel"
+		if cfg.Firewall.LogDropped == "nflog" {
+			source = "nflog"
+		}
+	}
+	asJSON := fs.Lookup("json").Value.String() == "true"
+	var blocked []linux.Blocked
+	switch source {
+	case "kernel":
+		if cfg.Firewall.LogDropped != "kernel" {
+			logger.Println("The Session Doesn't Log the Dropped Packets to the Kernel Log, Set firewall.log_dropped = \"kernel\"")
+		}
+		since := fs.Lookup("since").Value.(flag.Getter).Get().(time.Duration)
+		if blocked, err = linux.KernelBlocked(time.Now().Add(-since)); err != nil {
+			logger.Println("Can't Read the Kernel Log:", err)
+			return exitFailure
+		}
+	case "nflog":
+		group := fs.Lookup("group").Value.(flag.Getter).Get().(int)
+		if group < 0 {
+			group = cfg.Firewall.LogGroup
+		}
+		duration := fs.Lookup("duration").Value.(flag.Getter).Get().(time.Duration)
+		if blocked, err = listenNFLog(group, duration, !asJSON); err != nil {
+			logger.Println("Can't Listen to NFLOG:", err)
+			return exitFailure
+		}
+	default:
+		logger.Println("-source must be kernel or nflog")
+		return exitUsage
+	}
+	attempts := aggregate(blocked)
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(attempts)
+		return exitOK
+	}
+	if len(attempts) == 0 {
+		fmt.Println("No blocked packets")
+		return exitOK
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "COUNT\tUSER\tPROCESS\tPROTO\tDESTINATION\tLAST")
+	for _, a := range attempts {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", a.Count, orDash(a.User), orDash(a.Process),
+			a.Proto, a.Destination, a.Last.Format(time.RFC3339))
+	}
+	return exitOK
+}
+
+// Listens to the NFLOG group for duration or until interrupted, every
+// blocked packet is printed when verbose
+func listenNFLog(group int, duration time.Duration, verbose bool) ([]linux.Blocked, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	packets := make(chan linux.Blocked, 64)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- linux.NFLogBlocked(group, packets, ctx.Done())
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timeout = time.After(duration)
+	}
+	if verbose {
+		logger.Println("Listening to NFLOG Group", group)
+	}
+	var blocked []linux.Blocked
+	for {
+		select {
+		case b := <-packets:
+			// the socket is looked up at once, before the program closes it
+			if _, comm, err := linux.SocketProcess(b.Proto, b.SPort, b.UID); err == nil {
+				b.Process = comm
+			}
+			blocked = append(blocked, b)
+			if verbose {
+				fmt.Printf("%s %s uid=%d process=%s %s %s\n", b.Time.Format(time.RFC3339),
+					b.Proto, b.UID, orDash(b.Process), b.Src, b.Destination())
+			}
+		case err := <-errs:
+			return blocked, err
+		case <-sig:
+			return blocked, nil
+		case <-timeout:
+			return blocked, nil
+		}
+	}
+}
+
+// Groups the blocked packets by user, process, protocol and destination,
+// the most frequent first
+func aggregate(blocked []linux.Blocked) []attempt {
+	byKey := map[string]*attempt{}
+	users := map[int]string{}
+	for _, b := range blocked {
+		key := strconv.Itoa(b.UID) + " " + b.Process + " " + b.Proto + " " + b.Destination()
+		a, ok := byKey[key]
+		if !ok {
+			a = &attempt{UID: b.UID, Process: b.Process, Proto: b.Proto, Destination: b.Destination(), First: b.Time}
+			if _, ok := users[b.UID]; !ok && b.UID >= 0 {
+				if u, err := user.LookupId(strconv.Itoa(b.UID)); err == nil {
+					users[b.UID] = u.Username
+				}
+			}
+			a.User = users[b.UID]
+			byKey[key] = a
+		}
+		a.Count++
+		if b.Time.Before(a.First) {
+			a.First = b.Time
+		}
+		if b.Time.After(a.Last) {
+			a.Last = b.Time
+		}
+	}
+	attempts := make([]attempt, 0, len(byKey))
+	for _, a := range byKey {
+		attempts = append(attempts, *a)
+	}
+	sort.Slice(attempts, func(i, j int) bool {
+		if attempts[i].Count != attempts[j].Count {
+			return attempts[i].Count > attempts[j].Count
+		}
+		return attempts[i].Last.After(attempts[j].Last)
+	})
+	return attempts
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
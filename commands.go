@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/multiversecoder/hidemego/tools"
+)
+
+// exit codes shared by every subcommand
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// command describes a hidemego subcommand, its flags and its help text
+type command struct {
+	Name     string
+	Args     string
+	Short    string
+	Long     string
+	Examples []string
+	// Root is true when the command must be run as root
+	Root bool
+	// Flags registers the command flags on the given FlagSet
+	Flags func(fs *flag.FlagSet)
+	// Run executes the command once its flags are parsed and returns the
+	// process exit code. Positional arguments are available via fs.Args()
+	Run func(fs *flag.FlagSet) int
+}
+
+var commands = map[string]*command{}
+
+func register(c *command) {
+	if _, ok := commands[c.Name]; ok {
+		panic(fmt.Sprintf("command %s registered twice", c.Name))
+	}
+	commands[c.Name] = c
+}
+
+// Sorted list of registered command names
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Creates a new FlagSet populated with the command flags
+func (c *command) FlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("hidemego "+c.Name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	if c.Flags != nil {
+		c.Flags(fs)
+	}
+	fs.Usage = func() {
+		c.PrintHelp(fs.Output())
+	}
+	return fs
+}
+
+func (c *command) HasFlags() bool {
+	has := false
+	c.FlagSet().VisitAll(func(*flag.Flag) {
+		has = true
+	})
+	return has
+}
+
+func (c *command) PrintHelp(w io.Writer) {
+	fs := c.FlagSet()
+	synopsis := "hidemego " + c.Name
+	if c.HasFlags() {
+		synopsis += " [options]"
+	}
+	if c.Args != "" {
+		synopsis += " " + c.Args
+	}
+	fmt.Fprintf(w, "Usage: %s\n\n", synopsis)
+	if c.Long != "" {
+		fmt.Fprintf(w, "%s\n\n", strings.TrimSpace(c.Long))
+	} else {
+		fmt.Fprintf(w, "%s\n\n", c.Short)
+	}
+	if c.HasFlags() {
+		fmt.Fprintln(w, "Options:")
+		fs.SetOutput(w)
+		fs.PrintDefaults()
+		fmt.Fprintln(w)
+	}
+	if len(c.Examples) > 0 {
+		fmt.Fprintln(w, "Examples:")
+		for _, e := range c.Examples {
+			fmt.Fprintf(w, "  %s\n", e)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: hidemego <command> [options] [arguments]\n\n")
+	fmt.Fprintf(w, "hidemego - Network Anonymization Tool for Linux\n\n")
+	fmt.Fprintln(w, "Commands:")
+	names := commandNames()
+	width := 0
+	for _, name := range names {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, name, commands[name].Short)
+	}
+	fmt.Fprintf(w, "\nRun 'hidemego help <command>' for more information on a command.\n")
+}
+
+// Parses args and dispatches them to the matching subcommand
+func run(args []string) int {
+	if len(args) < 1 {
+		usage(os.Stderr)
+		return exitUsage
+	}
+	name := args[0]
+	switch name {
+	case "-h", "-help", "--help":
+		usage(os.Stdout)
+		return exitOK
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "hidemego: unknown command %q\n\n", name)
+		usage(os.Stderr)
+		return exitUsage
+	}
+	fs := cmd.FlagSet()
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if cmd.Root && !tools.IsRoot() {
+		logger.Println("You MUST BE ROOT to run this software")
+		return exitFailure
+	}
+	return cmd.Run(fs)
+}
+
+func init() {
+	register(&command{
+		Name:  "help",
+		Args:  "[command]",
+		Short: "Show help for hidemego or one of its commands",
+		Examples: []string{
+			"hidemego help",
+			"hidemego help start"},
+		Run: func(fs *flag.FlagSet) int {
+			args := fs.Args()
+			if len(args) == 0 {
+				usage(os.Stdout)
+				return exitOK
+			}
+			cmd, ok := commands[args[0]]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "hidemego: unknown command %q\n\n", args[0])
+				usage(os.Stderr)
+				return exitUsage
+			}
+			cmd.PrintHelp(os.Stdout)
+			return exitOK
+		}})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/multiversecoder/hidemego/tools"
+)
+
+// quoting-safe replacements for help strings used inside completion scripts
+var completionEscaper = strings.NewReplacer("'", "", "[", "(", "]", ")", "\n", " ")
+
+type completionFlag struct {
+	Name  string
+	Usage string
+}
+
+type completionCommand struct {
+	Name  string
+	Short string
+	Flags []completionFlag
+}
+
+func init() {
+	register(&command{
+		Name:  "completion",
+		Args:  "<bash|zsh|fish>",
+		Short: "Generate the shell completion script",
+		Long: `
+Prints the completion script for the given shell on stdout.`,
+		Examples: []string{
+			"hidemego completion bash > /etc/bash_completion.d/hidemego",
+			"hidemego completion zsh > /usr/local/share/zsh/site-functions/_hidemego",
+			"hidemego completion fish > ~/.config/fish/completions/hidemego.fish"},
+		Run: func(fs *flag.FlagSet) int {
+			if fs.NArg() != 1 {
+				fs.Usage()
+				return exitUsage
+			}
+			shell := fs.Arg(0)
+			switch shell {
+			case "bash", "zsh", "fish":
+			default:
+				fmt.Fprintf(os.Stderr, "hidemego: unsupported shell %q\n", shell)
+				return exitUsage
+			}
+			var cmds []completionCommand
+			for _, name := range commandNames() {
+				c := completionCommand{
+					Name:  name,
+					Short: completionEscaper.Replace(commands[name].Short)}
+				commands[name].FlagSet().VisitAll(func(f *flag.Flag) {
+					c.Flags = append(c.Flags, completionFlag{
+						Name:  f.Name,
+						Usage: completionEscaper.Replace(f.Usage)})
+				})
+				cmds = append(cmds, c)
+			}
+			tb, err := tools.Read(shell, map[string]interface{}{"Commands": cmds})
+			if err != nil {
+				logger.Println("Can't Generate Completion Script:", err)
+				return exitFailure
+			}
+			os.Stdout.Write(tb.Bytes())
+			return exitOK
+		}})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/multiversecoder/hidemego/config"
+)
+
+func init() {
+	register(&command{
+		Name:  "config",
+		Args:  "<validate|show|profiles>",
+		Short: "Validate or show the hidemego configuration and its profiles",
+		Long: `
+validate checks the syntax and the values of the configuration file and of
+every profile it defines.
+
+show prints the configuration file. With -effective it prints the settings
+start would use: the defaults merged with the file and the selected profile.
+
+profiles lists the built-in profiles and the ones defined in the file. A
+profile defined in the file replaces the built-in profile with the same name.`,
+		Examples: []string{
+			"hidemego config validate",
+			"hidemego config validate -config=./hidemego.toml",
+			"hidemego config show -effective -profile=work",
+			"hidemego config profiles"},
+		Flags: func(fs *flag.FlagSet) {
+			fs.String("config", config.DefaultPath, "Configuration file")
+			fs.String("profile", "", "Configuration profile to apply (show -effective only)")
+			fs.Bool("effective", false, "Show the effective configuration")
+		},
+		Run: func(fs *flag.FlagSet) int {
+			if fs.NArg() < 1 {
+				fs.Usage()
+				return exitUsage
+			}
+			action := fs.Arg(0)
+			// flags are accepted after the action too
+			if err := fs.Parse(fs.Args()[1:]); err != nil {
+				return exitUsage
+			}
+			if fs.NArg() > 0 {
+				fs.Usage()
+				return exitUsage
+			}
+			p := fs.Lookup("config").Value.String()
+			switch action {
+			case "validate":
+				f, err := config.Open(p)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return exitFailure
+				}
+				if err := f.Validate(); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return exitFailure
+				}
+				fmt.Printf("%s: OK\n", p)
+			case "show":
+				if fs.Lookup("effective").Value.String() != "true" {
+					b, err := ioutil.ReadFile(p)
+					if err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						return exitFailure
+					}
+					os.Stdout.Write(b)
+					return exitOK
+				}
+				f, err := config.OpenOrDefault(p)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return exitFailure
+				}
+				cfg, err := f.Config(fs.Lookup("profile").Value.String())
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return exitFailure
+				}
+				if err := cfg.Validate(); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return exitFailure
+				}
+				fmt.Print(cfg)
+			case "profiles":
+				f, err := config.OpenOrDefault(p)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return exitFailure
+				}
+				user := map[string]bool{}
+				for _, name := range f.Profiles() {
+					user[name] = true
+					fmt.Printf("%s\t%s\n", name, f.Path)
+				}
+				for _, name := range config.Builtins() {
+					if !user[name] {
+						fmt.Printf("%s\tbuilt-in\n", name)
+					}
+				}
+			default:
+				fmt.Fprintf(os.Stderr, "hidemego: unknown config action %q\n\n", action)
+				fs.Usage()
+				return exitUsage
+			}
+			return exitOK
+		}})
+}
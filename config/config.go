@@ -0,0 +1,903 @@
+package config
+
+import (
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/multiversecoder/hidemego/tor"
+)
+
+var (
+	// DefaultPath is the configuration file loaded by start
+	DefaultPath = path.Join("/", "etc", "hidemego", "hidemego.toml")
+	//go:embed profiles.toml
+	builtinProfiles []byte
+	builtins        map[string]interface{}
+	// MaxExcludeLast is the number of previous exits remembered by new
+	MaxExcludeLast = 100
+)
+
+func init() {
+	tree, err := parse(builtinProfiles)
+	if err != nil {
+		panic(fmt.Sprintf("built-in profiles: %v", err))
+	}
+	builtins = tree["profiles"].(map[string]interface{})
+}
+
+// Tor contains the tor process and listener settings
+type Tor struct {
+	User            string `toml:"user"`
+	ID              int    `toml:"id"`
+	ControlPassword string `toml:"control_password"`
+	TransPort       int    `toml:"trans_port"`
+	SocksDestPort   int    `toml:"socks_dest_port"`
+	SocksAuthPort   int    `toml:"socks_auth_port"`
+	ControlPort     int    `toml:"control_port"`
+	DNSPort         int    `toml:"dns_port"`
+	StrictNodes     bool   `toml:"strict_nodes"`
+	// MaxCircuitDirtiness is the lifetime of a circuit, zero keeps the tor
+	// default
+	MaxCircuitDirtiness time.Duration `toml:"max_circuit_dirtiness"`
+	UseBridges          bool          `toml:"use_bridges"`
+	// Bridges are bridge lines as accepted by the torrc Bridge option
+	Bridges []string `toml:"bridges"`
+	// BridgesFile is a file with one bridge line per line
+	BridgesFile string `toml:"bridges_file"`
+}
+
+// Nodes contains the tor node selection settings, every list accepts
+// ISO 3166-1 alpha-2 country codes and @group references
+type Nodes struct {
+	Exclude     []string `toml:"exclude"`
+	ExcludeExit []string `toml:"exclude_exit"`
+	Entry       []string `toml:"entry"`
+	Exit        []string `toml:"exit"`
+}
+
+// Returns the tor node policy
+func (c *Config) NodePolicy() tor.NodePolicy {
+	return tor.NodePolicy{
+		Exclude:     c.Nodes.Exclude,
+		ExcludeExit: c.Nodes.ExcludeExit,
+		Entry:       c.Nodes.Entry,
+		Exit:        c.Nodes.Exit,
+		Groups:      c.Groups}
+}
+
+// Network contains the interfaces settings
+type Network struct {
+	// Ifaces are the interfaces that must change MAC Address, "*" selects
+	// every physical interface
+	Ifaces []string `toml:"ifaces"`
+}
+
+// Firewall contains the iptables settings
+type Firewall struct {
+	// KillSwitch sets the default policies to DROP so that no traffic
+	// leaks when the hidemego rules are flushed by other programs
+	KillSwitch bool `toml:"killswitch"`
+	// LogDropped logs the packets dropped by the final rule to find the
+	// programs trying to leak: off, kernel for the kernel log or nflog
+	LogDropped string `toml:"log_dropped"`
+	// LogGroup is the NFLOG group of log_dropped = "nflog"
+	LogGroup int `toml:"log_group"`
+	// LogRate is the number of dropped packets logged per minute at most
+	LogRate int `toml:"log_rate"`
+}
+
+// Gateway contains the settings of the gateway mode
+type Gateway struct {
+	// Iface is the internal interface whose clients are routed through tor
+	Iface string `toml:"iface"`
+}
+
+// Isolation contains the stream isolation of the tor listeners, streams
+// that differ in an isolation property never share a circuit
+type Isolation struct {
+	// TransPort, SocksDestPort and SocksAuthPort are the isolation
+	// properties of the listeners: client_addr, client_protocol,
+	// dest_addr, dest_port, socks_auth and keep_alive_socks_auth
+	TransPort     []string `toml:"trans_port"`
+	SocksDestPort []string `toml:"socks_dest_port"`
+	SocksAuthPort []string `toml:"socks_auth_port"`
+	// Classes are traffic classes redirected to their own TransPort, they
+	// never share circuits with each other and with the rest of the traffic
+	Classes map[string]IsolationClass `toml:"classes"`
+}
+
+// IsolationClass selects the traffic of a dedicated TransPort
+type IsolationClass struct {
+	Port   int      `toml:"port"`
+	Users  []string `toml:"users"`
+	Groups []string `toml:"groups"`
+	// DestPorts restricts the class to the TCP destination ports, without
+	// users and groups it selects the connections of everyone to them
+	DestPorts []int `toml:"dest_ports"`
+	// Isolation are the isolation properties of the port, the ones of
+	// isolation.trans_port when empty
+	Isolation []string `toml:"isolation"`
+}
+
+// Returns the names of the isolation classes in order
+func (i Isolation) ClassNames() []string {
+	names := make([]string, 0, len(i.Classes))
+	for name := range i.Classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Containers contains the container networks routed through tor
+type Containers struct {
+	// Networks are docker or podman bridge networks, by network or
+	// bridge name
+	Networks []string `toml:"networks"`
+}
+
+// SplitTunnel contains the traffic that doesn't go through tor
+type SplitTunnel struct {
+	// Mode is bypass, the listed users, groups and cgroups bypass tor, or
+	// torify, only the listed users, groups and cgroups go through tor
+	Mode string `toml:"mode"`
+	// Users and Groups are names or numeric ids
+	Users  []string `toml:"users"`
+	Groups []string `toml:"groups"`
+	// CGroups are cgroup v2 paths, e.g. system.slice/backup.service
+	CGroups []string `toml:"cgroups"`
+	// Networks are the IPv4 destinations that always bypass tor
+	Networks []string `toml:"networks"`
+}
+
+// UDP contains the handling of the UDP traffic, tor carries only TCP and
+// the DNS queries
+type UDP struct {
+	// Policy is drop, log to log with NFLOG and drop, or reject to fail
+	// fast with an ICMP port unreachable
+	Policy string `toml:"policy"`
+	// NFLogGroup is the NFLOG group of the log policy
+	NFLogGroup int `toml:"nflog_group"`
+	// Allow are the IPv4 destinations reached without tor, as address:port
+	// or CIDR:port, e.g. 192.168.1.1:123 for a local NTP server
+	Allow []string `toml:"allow"`
+}
+
+// UDPDest is a destination of udp.allow
+type UDPDest struct {
+	Network string
+	Port    int
+}
+
+func (d UDPDest) String() string {
+	return d.Network + ":" + strconv.Itoa(d.Port)
+}
+
+// Parses the destinations of udp.allow
+func (u UDP) Destinations() ([]UDPDest, error) {
+	var dests []UDPDest
+	for _, a := range u.Allow {
+		i := strings.LastIndex(a, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("udp.allow: %q: expected address:port or CIDR:port", a)
+		}
+		d := UDPDest{Network: a[:i]}
+		ip := net.ParseIP(d.Network)
+		if ip == nil {
+			var err error
+			if ip, _, err = net.ParseCIDR(d.Network); err != nil {
+				return nil, fmt.Errorf("udp.allow: invalid network %q", d.Network)
+			}
+		}
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("udp.allow: %s is not an IPv4 network", d.Network)
+		}
+		p, err := strconv.Atoi(a[i+1:])
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("udp.allow: %q: invalid port", a)
+		}
+		if p == 53 {
+			return nil, fmt.Errorf("udp.allow: %q: DNS is always resolved by tor", a)
+		}
+		d.Port = p
+		dests = append(dests, d)
+	}
+	return dests, nil
+}
+
+func (u UDP) validate() error {
+	if u.Policy != "drop" && u.Policy != "log" && u.Policy != "reject" {
+		return fmt.Errorf("udp.policy: must be drop, log or reject")
+	}
+	if u.NFLogGroup < 0 || u.NFLogGroup > 65535 {
+		return fmt.Errorf("udp.nflog_group: must be between 0 and 65535")
+	}
+	_, err := u.Destinations()
+	return err
+}
+
+// UpstreamProxy contains the proxy tor connects through
+type UpstreamProxy struct {
+	// URL is http://host:port, socks4://host:port or socks5://host:port
+	URL string `toml:"url"`
+	// CredentialsFile contains a single user:password line
+	CredentialsFile string `toml:"credentials_file"`
+}
+
+// LocalProxy contains the proxies the daemon runs in front of the tor
+// SocksAuthPort, the credentials of their clients select the circuits
+type LocalProxy struct {
+	// HTTP is the loopback address of the HTTP CONNECT proxy, empty
+	// disables it
+	HTTP string `toml:"http"`
+	// SOCKS is the loopback address of the SOCKS5 proxy, empty disables it
+	SOCKS string `toml:"socks"`
+	// CredentialsFile lists the accepted user:password lines, any
+	// credentials are accepted when it is empty
+	CredentialsFile string `toml:"credentials_file"`
+}
+
+// Returns true when one of the proxies is enabled
+func (l LocalProxy) Enabled() bool {
+	return l.HTTP != "" || l.SOCKS != ""
+}
+
+func (l LocalProxy) validate(ports map[int]string) error {
+	for _, a := range []struct {
+		name string
+		addr string
+	}{
+		{"local_proxy.http", l.HTTP},
+		{"local_proxy.socks", l.SOCKS},
+	} {
+		if a.addr == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(a.addr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", a.name, err)
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("%s: %s is not a loopback address", a.name, host)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("%s: invalid port %s", a.name, port)
+		}
+		if other, ok := ports[p]; ok {
+			return fmt.Errorf("%s: port %d already used by %s", a.name, p, other)
+		}
+		ports[p] = a.name
+	}
+	if l.CredentialsFile != "" {
+		if !l.Enabled() {
+			return fmt.Errorf("local_proxy.credentials_file: requires local_proxy.http or local_proxy.socks")
+		}
+		if _, err := tor.ReadProxyUsers(l.CredentialsFile); err != nil {
+			return fmt.Errorf("local_proxy.credentials_file: %v", err)
+		}
+	}
+	return nil
+}
+
+// DNS contains the tor DNSPort settings
+type DNS struct {
+	// Cache enables the tor client side DNS cache
+	Cache bool `toml:"cache"`
+}
+
+// Identity contains the identity rotation settings
+type Identity struct {
+	// RotateEvery is the interval between two NEWNYM sent by rotate, zero
+	// disables the scheduled rotation
+	RotateEvery time.Duration `toml:"rotate_every"`
+	// Attempts is the number of NEWNYM sent until the exit IP changes
+	Attempts int `toml:"attempts"`
+	// ExcludeLast is the number of previous exits new never selects again
+	ExcludeLast int `toml:"exclude_last"`
+}
+
+// Watch contains the drift detection settings of the daemon
+type Watch struct {
+	// Interval is the time between two checks of the session state
+	Interval time.Duration `toml:"interval"`
+	// OnDrift is reapply to restore what changed or killswitch to block
+	// all the traffic
+	OnDrift string `toml:"on_drift"`
+	// Events checks the session as soon as resolv.conf or a network
+	// interface changes
+	Events bool `toml:"events"`
+}
+
+// TimeSync contains the settings of the clock synchronization through tor,
+// NTP can't go through tor and is blocked by the firewall
+type TimeSync struct {
+	// Enabled sets the clock when the session starts and, while the daemon
+	// runs, every Interval
+	Enabled bool `toml:"enabled"`
+	// Sources are the https URLs, or http onion URLs, whose Date header is
+	// read through tor
+	Sources []string `toml:"sources"`
+	// MinSources is the number of sources that must answer
+	MinSources int `toml:"min_sources"`
+	// MaxStep is the largest correction applied to the clock, larger
+	// offsets are reported and left alone
+	MaxStep  time.Duration `toml:"max_step"`
+	Interval time.Duration `toml:"interval"`
+}
+
+// Kernel contains the sysctl hardening settings
+type Kernel struct {
+	Harden bool `toml:"harden"`
+}
+
+// Config is the hidemego configuration as read from hidemego.toml
+type Config struct {
+	// Profile is the name of the profile applied to the configuration
+	Profile  string   `toml:"profile"`
+	Tor      Tor      `toml:"tor"`
+	Nodes    Nodes    `toml:"nodes"`
+	Network  Network  `toml:"network"`
+	Firewall Firewall `toml:"firewall"`
+	DNS      DNS      `toml:"dns"`
+	Kernel   Kernel   `toml:"kernel"`
+	Identity Identity `toml:"identity"`
+	Watch    Watch    `toml:"watch"`
+	Gateway  Gateway  `toml:"gateway"`
+	// Containers are the container networks routed through tor
+	Containers Containers `toml:"containers"`
+	Isolation  Isolation  `toml:"isolation"`
+	// SplitTunnel is the traffic that bypasses tor
+	SplitTunnel SplitTunnel `toml:"split_tunnel"`
+	// UDP is the handling of the UDP traffic
+	UDP UDP `toml:"udp"`
+	// UpstreamProxy is the proxy tor connects through
+	UpstreamProxy UpstreamProxy `toml:"upstream_proxy"`
+	// LocalProxy are the proxies the daemon runs for the applications
+	LocalProxy LocalProxy `toml:"local_proxy"`
+	TimeSync   TimeSync   `toml:"time_sync"`
+	// Groups are user defined country groups referenced as @name
+	Groups map[string][]string `toml:"groups"`
+}
+
+// File is a parsed configuration file
+type File struct {
+	Path string
+	tree map[string]interface{}
+}
+
+// DefaultExcludeExit are the countries never used as exit unless
+// nodes.exclude_exit is set, the list excluded by the previous releases.
+// The wider @14eyes+ group is opt-in.
+var DefaultExcludeExit = []string{"us", "au", "ca", "nz", "gb", "fr", "sg", "jp", "kp", "se", "il", "es", "it", "no", "dk", "nl", "be"}
+
+// Returns the configuration used when no file is found
+func Default() Config {
+	return Config{
+		Tor: Tor{
+			TransPort:     9040,
+			SocksDestPort: 9051,
+			SocksAuthPort: 9151,
+			ControlPort:   9052,
+			DNSPort:       5354,
+			StrictNodes:   true},
+		Nodes: Nodes{
+			ExcludeExit: append([]string(nil), DefaultExcludeExit...)},
+		Firewall: Firewall{
+			LogDropped: "off",
+			LogRate:    30},
+		Kernel: Kernel{
+			Harden: true},
+		Identity: Identity{
+			Attempts: 3},
+		Watch: Watch{
+			Interval: 10 * time.Second,
+			OnDrift:  "reapply",
+			Events:   true},
+		SplitTunnel: SplitTunnel{
+			Mode: "bypass"},
+		UDP: UDP{
+			Policy: "drop"},
+		TimeSync: TimeSync{
+			Sources: []string{
+				"https://www.torproject.org",
+				"https://www.eff.org",
+				"https://www.wikipedia.org",
+				"https://duckduckgo.com",
+				"http://2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid.onion"},
+			MinSources: 3,
+			MaxStep:    24 * time.Hour,
+			Interval:   time.Hour},
+		Isolation: Isolation{
+			TransPort:     []string{"client_addr", "client_protocol", "dest_addr", "dest_port"},
+			SocksDestPort: []string{"client_addr", "dest_addr", "dest_port", "socks_auth"},
+			SocksAuthPort: []string{"client_addr", "socks_auth", "keep_alive_socks_auth"}}}
+}
+
+// Reads and parses the configuration file at p
+func Open(p string) (*File, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return &File{Path: p, tree: tree}, nil
+}
+
+// Reads the configuration file at p, a missing DefaultPath is not an error
+// and results in an empty configuration file
+func OpenOrDefault(p string) (*File, error) {
+	f, err := Open(p)
+	if os.IsNotExist(err) && p == DefaultPath {
+		return &File{Path: p, tree: map[string]interface{}{}}, nil
+	}
+	return f, err
+}
+
+// Lists the built-in profiles
+func Builtins() []string {
+	var names []string
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lists the profiles defined in the file
+func (f *File) Profiles() []string {
+	var names []string
+	if p, ok := f.tree["profiles"].(map[string]interface{}); ok {
+		for name := range p {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Builds the configuration merging the defaults, the top level settings and
+// the given profile, defined as a [profiles.<name>] table. An empty profile
+// selects the one named by the top level profile key, if any.
+func (f *File) Config(profile string) (Config, error) {
+	c := Default()
+	tree := map[string]interface{}{}
+	var selected string
+	for k, v := range f.tree {
+		switch k {
+		case "profile":
+			p, ok := v.(string)
+			if !ok {
+				return c, fmt.Errorf("%s: profile: expected a string", f.Path)
+			}
+			selected = p
+		case "profiles":
+		default:
+			tree[k] = v
+		}
+	}
+	if profile != "" {
+		selected = profile
+	}
+	if selected != "" {
+		p, ok := f.profile(selected)
+		if !ok {
+			return c, fmt.Errorf("%s: unknown profile %s", f.Path, selected)
+		}
+		merge(tree, p)
+	}
+	if err := decode(tree, reflect.ValueOf(&c).Elem(), ""); err != nil {
+		return c, fmt.Errorf("%s: %v", f.Path, err)
+	}
+	c.Profile = selected
+	return c, nil
+}
+
+// Returns the profile defined in the file or the built-in one
+func (f *File) profile(name string) (map[string]interface{}, bool) {
+	if profiles, ok := f.tree["profiles"].(map[string]interface{}); ok {
+		if p, ok := profiles[name].(map[string]interface{}); ok {
+			return p, true
+		}
+	}
+	p, ok := builtins[name].(map[string]interface{})
+	return p, ok
+}
+
+// Checks the top level configuration and every profile defined in the file
+func (f *File) Validate() error {
+	c, err := f.Config("")
+	if err != nil {
+		return err
+	}
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("%s: %v", f.Path, err)
+	}
+	for _, name := range f.Profiles() {
+		c, err := f.Config(name)
+		if err != nil {
+			return err
+		}
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("%s: profile %s: %v", f.Path, name, err)
+		}
+	}
+	return nil
+}
+
+// Recursively copies src over dst
+func merge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		sm, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		dm, ok := dst[k].(map[string]interface{})
+		if !ok {
+			dm = map[string]interface{}{}
+		} else {
+			// never modify the tree of the parsed file
+			dm = copyTree(dm)
+		}
+		merge(dm, sm)
+		dst[k] = dm
+	}
+}
+
+func copyTree(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if t, ok := v.(map[string]interface{}); ok {
+			v = copyTree(t)
+		}
+		c[k] = v
+	}
+	return c
+}
+
+// Sets the value identified by the dotted key, e.g. tor.trans_port
+func (c *Config) Set(key, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	parts := strings.Split(key, ".")
+	for i, p := range parts {
+		t := v.Type()
+		found := false
+		for j := 0; j < t.NumField(); j++ {
+			if t.Field(j).Tag.Get("toml") == p {
+				v = v.Field(j)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown key %s", key)
+		}
+		if i < len(parts)-1 && v.Kind() != reflect.Struct {
+			return fmt.Errorf("unknown key %s", key)
+		}
+	}
+	return assignString(v, value, key)
+}
+
+// Parses the bridge lines of tor.bridges and tor.bridges_file
+func (c *Config) BridgeLines() ([]tor.Bridge, error) {
+	var bridges []tor.Bridge
+	for _, line := range c.Tor.Bridges {
+		b, err := tor.ParseBridge(line)
+		if err != nil {
+			return nil, fmt.Errorf("tor.bridges: %q: %v", line, err)
+		}
+		bridges = append(bridges, b)
+	}
+	if c.Tor.BridgesFile != "" {
+		b, err := tor.ReadBridges(c.Tor.BridgesFile)
+		if err != nil {
+			return nil, fmt.Errorf("tor.bridges_file: %v", err)
+		}
+		bridges = append(bridges, b...)
+	}
+	return bridges, nil
+}
+
+// Parses the upstream proxy and reads its credentials, returns nil when no
+// proxy is configured
+func (c *Config) Proxy() (*tor.Proxy, error) {
+	if c.UpstreamProxy.URL == "" {
+		if c.UpstreamProxy.CredentialsFile != "" {
+			return nil, fmt.Errorf("upstream_proxy.credentials_file: requires upstream_proxy.url")
+		}
+		return nil, nil
+	}
+	p, err := tor.ParseProxy(c.UpstreamProxy.URL)
+	if err != nil {
+		return nil, fmt.Errorf("upstream_proxy.url: %v", err)
+	}
+	if c.UpstreamProxy.CredentialsFile != "" {
+		if err := p.ReadCredentials(c.UpstreamProxy.CredentialsFile); err != nil {
+			return nil, fmt.Errorf("upstream_proxy.credentials_file: %v", err)
+		}
+	}
+	return &p, nil
+}
+
+// Checks the configuration values
+func (c *Config) Validate() error {
+	ports := map[int]string{}
+	for _, p := range []struct {
+		name string
+		port int
+	}{
+		{"tor.trans_port", c.Tor.TransPort},
+		{"tor.socks_dest_port", c.Tor.SocksDestPort},
+		{"tor.socks_auth_port", c.Tor.SocksAuthPort},
+		{"tor.control_port", c.Tor.ControlPort},
+		{"tor.dns_port", c.Tor.DNSPort},
+	} {
+		if p.port < 1 || p.port > 65535 {
+			return fmt.Errorf("%s: invalid port %d", p.name, p.port)
+		}
+		if other, ok := ports[p.port]; ok {
+			return fmt.Errorf("%s: port %d already used by %s", p.name, p.port, other)
+		}
+		ports[p.port] = p.name
+	}
+	if c.Tor.ID < 0 {
+		return fmt.Errorf("tor.id: invalid user id %d", c.Tor.ID)
+	}
+	if err := c.Isolation.validate(ports, c.SplitTunnel.Mode); err != nil {
+		return err
+	}
+	if err := c.LocalProxy.validate(ports); err != nil {
+		return err
+	}
+	for name, members := range c.Groups {
+		if name != strings.ToLower(name) || strings.ContainsAny(name, "@, ") {
+			return fmt.Errorf("groups.%s: group names must be lower case without @, commas or spaces", name)
+		}
+		if _, err := tor.ExpandCountries(members, c.Groups); err != nil {
+			return fmt.Errorf("groups.%s: %v", name, err)
+		}
+	}
+	if _, err := c.NodePolicy().Selection(); err != nil {
+		return fmt.Errorf("nodes: %v", err)
+	}
+	for _, i := range c.Network.Ifaces {
+		if strings.TrimSpace(i) == "" || strings.ContainsAny(i, " /") {
+			return fmt.Errorf("network.ifaces: invalid interface name %q", i)
+		}
+		if i == "*" && len(c.Network.Ifaces) > 1 {
+			return fmt.Errorf("network.ifaces: * can't be combined with other interfaces")
+		}
+	}
+	if g := c.Gateway.Iface; g != "" {
+		if strings.TrimSpace(g) != g || strings.ContainsAny(g, " /*") {
+			return fmt.Errorf("gateway.iface: invalid interface name %q", g)
+		}
+	}
+	for _, n := range c.Containers.Networks {
+		if strings.TrimSpace(n) != n || n == "" || strings.ContainsAny(n, " /*") {
+			return fmt.Errorf("containers.networks: invalid network name %q", n)
+		}
+		if n == c.Gateway.Iface {
+			return fmt.Errorf("containers.networks: %s is the gateway interface", n)
+		}
+	}
+	if c.Tor.MaxCircuitDirtiness < 0 || (c.Tor.MaxCircuitDirtiness > 0 && c.Tor.MaxCircuitDirtiness < 10*time.Second) {
+		return fmt.Errorf("tor.max_circuit_dirtiness: must be at least 10s")
+	}
+	if c.Identity.RotateEvery < 0 || (c.Identity.RotateEvery > 0 && c.Identity.RotateEvery < tor.NewnymInterval) {
+		return fmt.Errorf("identity.rotate_every: must be at least %s", tor.NewnymInterval)
+	}
+	if c.Identity.Attempts < 1 {
+		return fmt.Errorf("identity.attempts: must be at least 1")
+	}
+	if c.Identity.ExcludeLast < 0 || c.Identity.ExcludeLast > MaxExcludeLast {
+		return fmt.Errorf("identity.exclude_last: must be between 0 and %d", MaxExcludeLast)
+	}
+	if c.Watch.Interval < time.Second {
+		return fmt.Errorf("watch.interval: must be at least 1s")
+	}
+	if c.Watch.OnDrift != "reapply" && c.Watch.OnDrift != "killswitch" {
+		return fmt.Errorf("watch.on_drift: must be reapply or killswitch")
+	}
+	if err := c.SplitTunnel.validate(); err != nil {
+		return err
+	}
+	if err := c.UDP.validate(); err != nil {
+		return err
+	}
+	switch c.Firewall.LogDropped {
+	case "off", "kernel", "nflog":
+	default:
+		return fmt.Errorf("firewall.log_dropped: must be off, kernel or nflog")
+	}
+	if c.Firewall.LogGroup < 0 || c.Firewall.LogGroup > 65535 {
+		return fmt.Errorf("firewall.log_group: must be between 0 and 65535")
+	}
+	if c.Firewall.LogRate < 1 || c.Firewall.LogRate > 10000 {
+		return fmt.Errorf("firewall.log_rate: must be between 1 and 10000")
+	}
+	if err := c.TimeSync.validate(); err != nil {
+		return err
+	}
+	// the local proxies and timesync select the circuits with the SOCKS
+	// credentials
+	socksAuth := false
+	for _, n := range c.Isolation.SocksAuthPort {
+		socksAuth = socksAuth || n == "socks_auth"
+	}
+	if !socksAuth && c.LocalProxy.Enabled() {
+		return fmt.Errorf("isolation.socks_auth_port: socks_auth is required by local_proxy")
+	}
+	if !socksAuth && c.TimeSync.Enabled {
+		return fmt.Errorf("isolation.socks_auth_port: socks_auth is required by time_sync")
+	}
+	bridges, err := c.BridgeLines()
+	if err != nil {
+		return err
+	}
+	if c.Tor.UseBridges && len(bridges) == 0 {
+		return fmt.Errorf("tor.use_bridges: at least one bridge line is required in tor.bridges or tor.bridges_file")
+	}
+	if _, err := c.Proxy(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returns the configuration encoded as TOML
+func (c Config) String() string {
+	var b strings.Builder
+	encode(&b, reflect.ValueOf(c), "")
+	return b.String()
+}
+
+// Writes the configuration as TOML to p, a configuration Read can't decode
+// back unchanged is not written
+func (c Config) Write(p string) error {
+	s := c.String()
+	tree, err := parse([]byte(s))
+	if err != nil {
+		return fmt.Errorf("can't encode the configuration: %v", err)
+	}
+	back := Default()
+	if err := decode(tree, reflect.ValueOf(&back).Elem(), ""); err != nil {
+		return fmt.Errorf("can't encode the configuration: %v", err)
+	}
+	if back.String() != s {
+		return fmt.Errorf("can't encode the configuration: it changes when read back")
+	}
+	return ioutil.WriteFile(p, []byte(s), 0600)
+}
+
+// Reads a configuration written by Write
+func Read(p string) (Config, error) {
+	f, err := Open(p)
+	if err != nil {
+		return Config{}, err
+	}
+	c := Default()
+	if err := decode(f.tree, reflect.ValueOf(&c).Elem(), ""); err != nil {
+		return c, fmt.Errorf("%s: %v", p, err)
+	}
+	return c, nil
+}
+
+var (
+	// user and group names as accepted by useradd, or numeric ids
+	accountRgx = regexp.MustCompile(`^([a-z_][a-z0-9_.-]*\$?|[0-9]+)$`)
+	cgroupRgx  = regexp.MustCompile(`^[A-Za-z0-9_.@:/-]+$`)
+)
+
+// Validates the isolation properties and the classes, ports are the tor
+// ports already in use
+func (i Isolation) validate(ports map[int]string, splitMode string) error {
+	for _, l := range []struct {
+		name string
+		list []string
+	}{{"trans_port", i.TransPort}, {"socks_dest_port", i.SocksDestPort}, {"socks_auth_port", i.SocksAuthPort}} {
+		if _, err := tor.IsolationFlags(l.list); err != nil {
+			return fmt.Errorf("isolation.%s: %v", l.name, err)
+		}
+	}
+	if len(i.Classes) > 0 && splitMode == "torify" {
+		return fmt.Errorf("isolation.classes: can't be used with split_tunnel.mode = torify")
+	}
+	for _, name := range i.ClassNames() {
+		cl := i.Classes[name]
+		key := "isolation.classes." + name
+		if cl.Port < 1 || cl.Port > 65535 {
+			return fmt.Errorf("%s.port: invalid port %d", key, cl.Port)
+		}
+		if other, ok := ports[cl.Port]; ok {
+			return fmt.Errorf("%s.port: port %d already used by %s", key, cl.Port, other)
+		}
+		ports[cl.Port] = key + ".port"
+		if len(cl.Users)+len(cl.Groups)+len(cl.DestPorts) == 0 {
+			return fmt.Errorf("%s: needs users, groups or dest_ports", key)
+		}
+		for _, a := range append(append([]string{}, cl.Users...), cl.Groups...) {
+			if !accountRgx.MatchString(a) {
+				return fmt.Errorf("%s: invalid user or group %q", key, a)
+			}
+		}
+		for _, p := range cl.DestPorts {
+			if p < 1 || p > 65535 {
+				return fmt.Errorf("%s.dest_ports: invalid port %d", key, p)
+			}
+		}
+		if _, err := tor.IsolationFlags(cl.Isolation); err != nil {
+			return fmt.Errorf("%s.isolation: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func (s SplitTunnel) validate() error {
+	if s.Mode != "bypass" && s.Mode != "torify" {
+		return fmt.Errorf("split_tunnel.mode: must be bypass or torify")
+	}
+	for _, l := range []struct {
+		name string
+		list []string
+	}{{"users", s.Users}, {"groups", s.Groups}} {
+		for _, a := range l.list {
+			if !accountRgx.MatchString(a) {
+				return fmt.Errorf("split_tunnel.%s: invalid name %q", l.name, a)
+			}
+		}
+	}
+	for _, cg := range s.CGroups {
+		if !cgroupRgx.MatchString(cg) || strings.Contains(cg, "..") {
+			return fmt.Errorf("split_tunnel.cgroups: invalid cgroup path %q", cg)
+		}
+	}
+	for _, n := range s.Networks {
+		ip := net.ParseIP(n)
+		if ip == nil {
+			var err error
+			if ip, _, err = net.ParseCIDR(n); err != nil {
+				return fmt.Errorf("split_tunnel.networks: invalid network %q", n)
+			}
+		}
+		if ip.To4() == nil {
+			return fmt.Errorf("split_tunnel.networks: %s is not an IPv4 network", n)
+		}
+	}
+	if s.Mode == "torify" && len(s.Users)+len(s.Groups)+len(s.CGroups) == 0 {
+		return fmt.Errorf("split_tunnel.mode: torify requires at least one user, group or cgroup")
+	}
+	return nil
+}
+
+func (t TimeSync) validate() error {
+	for _, s := range t.Sources {
+		if _, err := tor.ParseClockSource(s); err != nil {
+			return fmt.Errorf("time_sync.sources: %v", err)
+		}
+	}
+	if t.MinSources < 1 || t.MinSources > len(t.Sources) {
+		return fmt.Errorf("time_sync.min_sources: must be between 1 and the number of sources (%d)", len(t.Sources))
+	}
+	if t.MaxStep < time.Second {
+		return fmt.Errorf("time_sync.max_step: must be at least 1s")
+	}
+	if t.Interval < time.Minute {
+		return fmt.Errorf("time_sync.interval: must be at least 1m")
+	}
+	return nil
+}
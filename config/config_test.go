@@ -0,0 +1,27 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateSocksAuth(t *testing.T) {
+	c := Default()
+	if err := c.Validate(); err != nil {
+		t.Fatalf("default configuration: %v", err)
+	}
+	c.Isolation.SocksAuthPort = []string{"keep_alive_socks_auth"}
+	if err := c.Validate(); err != nil {
+		t.Errorf("without the local proxies and timesync: %v", err)
+	}
+	p := c
+	p.LocalProxy.SOCKS = "127.0.0.1:1080"
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "socks_auth is required by local_proxy") {
+		t.Errorf("local_proxy without socks_auth: error %v", err)
+	}
+	s := c
+	s.TimeSync.Enabled = true
+	if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "socks_auth is required by time_sync") {
+		t.Errorf("time_sync without socks_auth: error %v", err)
+	}
+}
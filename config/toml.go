@@ -0,0 +1,539 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The parser understands the subset of TOML used by hidemego configuration
+// files: comments, tables, dotted and quoted keys, strings, integers,
+// booleans and (multiline) arrays of those values.
+
+type parser struct {
+	lines []string
+	n     int
+	root  map[string]interface{}
+}
+
+func parse(data []byte) (map[string]interface{}, error) {
+	p := &parser{
+		lines: strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n"),
+		root:  map[string]interface{}{}}
+	current := p.root
+	// headers are the tables opened by a [table] header
+	headers := map[string]bool{}
+	for p.n = 0; p.n < len(p.lines); p.n++ {
+		line := strings.TrimSpace(stripComment(p.lines[p.n]))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, p.errorf("invalid table header %s", line)
+			}
+			keys, rest, err := splitKey(line[1 : len(line)-1])
+			if err == nil && rest != "" {
+				err = fmt.Errorf("invalid key near %q", rest)
+			}
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			name := strings.Join(keys, "\x00")
+			if headers[name] {
+				return nil, p.errorf("duplicate table %s", strings.Join(keys, "."))
+			}
+			headers[name] = true
+			if current, err = table(p.root, keys); err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			continue
+		}
+		// the = is searched after the key, a quoted key may contain one
+		keys, rest, err := splitKey(line)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if !strings.HasPrefix(rest, "=") {
+			if strings.Contains(rest, "=") {
+				return nil, p.errorf("invalid key near %q", rest)
+			}
+			return nil, p.errorf("expected key = value")
+		}
+		raw := strings.TrimSpace(rest[1:])
+		// arrays may span multiple lines
+		for strings.HasPrefix(raw, "[") && !balanced(raw) && p.n+1 < len(p.lines) {
+			p.n++
+			raw += " " + strings.TrimSpace(stripComment(p.lines[p.n]))
+		}
+		value, rest, err := parseValue(raw)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, p.errorf("unexpected %q after value", rest)
+		}
+		t, err := table(current, keys[:len(keys)-1])
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		key := keys[len(keys)-1]
+		if _, ok := t[key]; ok {
+			return nil, p.errorf("duplicate key %s", key)
+		}
+		t[key] = value
+	}
+	return p.root, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.n+1, fmt.Sprintf(format, args...))
+}
+
+// Returns the nested table identified by keys creating it when needed
+func table(root map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	t := root
+	for _, k := range keys {
+		v, ok := t[k]
+		if !ok {
+			n := map[string]interface{}{}
+			t[k] = n
+			t = n
+			continue
+		}
+		n, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("key %s is not a table", k)
+		}
+		t = n
+	}
+	return t, nil
+}
+
+// Removes a trailing comment ignoring # characters inside strings
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func balanced(raw string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth == 0
+}
+
+// Splits a dotted key and returns the text following it
+func splitKey(s string) ([]string, string, error) {
+	var keys []string
+	s = strings.TrimSpace(s)
+	for {
+		if s == "" {
+			return nil, "", fmt.Errorf("missing key")
+		}
+		var key string
+		switch s[0] {
+		case '"', '\'':
+			v, rest, err := parseString(s)
+			if err != nil {
+				return nil, "", err
+			}
+			key, s = v, rest
+		default:
+			i := strings.IndexFunc(s, func(r rune) bool {
+				return !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-')
+			})
+			if i < 0 {
+				i = len(s)
+			}
+			key, s = s[:i], s[i:]
+			if key == "" {
+				return nil, "", fmt.Errorf("invalid key near %q", s)
+			}
+		}
+		keys = append(keys, key)
+		s = strings.TrimSpace(s)
+		if !strings.HasPrefix(s, ".") {
+			return keys, s, nil
+		}
+		s = strings.TrimSpace(s[1:])
+	}
+}
+
+func parseValue(s string) (interface{}, string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+	switch s[0] {
+	case '"', '\'':
+		return parseString(s)
+	case '[':
+		var list []interface{}
+		s = strings.TrimSpace(s[1:])
+		for {
+			if s == "" {
+				return nil, "", fmt.Errorf("unterminated array")
+			}
+			if s[0] == ']' {
+				return list, s[1:], nil
+			}
+			v, rest, err := parseValue(s)
+			if err != nil {
+				return nil, "", err
+			}
+			list = append(list, v)
+			s = strings.TrimSpace(rest)
+			if strings.HasPrefix(s, ",") {
+				s = strings.TrimSpace(s[1:])
+			} else if !strings.HasPrefix(s, "]") {
+				return nil, "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+	}
+	i := strings.IndexAny(s, ",] \t")
+	if i < 0 {
+		i = len(s)
+	}
+	word, rest := s[:i], s[i:]
+	switch word {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 0, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid value %s", word)
+	}
+	return n, rest, nil
+}
+
+func parseString(s string) (string, string, error) {
+	quote := s[0]
+	if quote == '\'' {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			if i+1 >= len(s) {
+				return "", "", fmt.Errorf("unterminated string")
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(s[i])
+			case 'u':
+				if i+4 >= len(s) {
+					return "", "", fmt.Errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", "", fmt.Errorf("invalid unicode escape")
+				}
+				b.WriteRune(rune(r))
+				i += 4
+			default:
+				return "", "", fmt.Errorf("invalid escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Decodes the parsed tree m into the struct pointed by v using the toml
+// field tags. Unknown keys are reported as errors.
+func decode(m map[string]interface{}, v reflect.Value, prefix string) error {
+	t := v.Type()
+	fields := map[string]int{}
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("toml"); tag != "" && tag != "-" {
+			fields[tag] = i
+		}
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		i, ok := fields[k]
+		if !ok {
+			return fmt.Errorf("unknown key %s%s", prefix, k)
+		}
+		if err := assign(v.Field(i), m[k], prefix+k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func assign(f reflect.Value, value interface{}, key string) error {
+	if f.Type() == durationType {
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a duration string", key)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.Struct:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected a table", key)
+		}
+		return decode(m, f, key+".")
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string", key)
+		}
+		f.SetString(s)
+	case reflect.Int:
+		n, ok := value.(int64)
+		if !ok {
+			return fmt.Errorf("%s: expected an integer", key)
+		}
+		f.SetInt(n)
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("%s: expected a boolean", key)
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an array", key)
+		}
+		s := reflect.MakeSlice(f.Type(), len(list), len(list))
+		for i, e := range list {
+			if err := assign(s.Index(i), e, fmt.Sprintf("%s[%d]", key, i)); err != nil {
+				return err
+			}
+		}
+		f.Set(s)
+	case reflect.Map:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected a table", key)
+		}
+		n := reflect.MakeMapWithSize(f.Type(), len(m))
+		for k, e := range m {
+			ev := reflect.New(f.Type().Elem()).Elem()
+			if err := assign(ev, e, key+"."+k); err != nil {
+				return err
+			}
+			n.SetMapIndex(reflect.ValueOf(k), ev)
+		}
+		f.Set(n)
+	default:
+		return fmt.Errorf("%s: unsupported type %s", key, f.Type())
+	}
+	return nil
+}
+
+// Parses the string s into the field f, used by flag overrides
+func assignString(f reflect.Value, s, key string) error {
+	if f.Type() == durationType {
+		return assign(f, s, key)
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%s: expected an integer", key)
+		}
+		f.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%s: expected a boolean", key)
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		var list []interface{}
+		for _, e := range strings.Split(s, ",") {
+			if e = strings.TrimSpace(e); e == "" {
+				continue
+			}
+			if f.Type().Elem().Kind() == reflect.Int {
+				n, err := strconv.ParseInt(e, 10, 64)
+				if err != nil {
+					return fmt.Errorf("%s: expected a list of integers", key)
+				}
+				list = append(list, n)
+				continue
+			}
+			list = append(list, e)
+		}
+		return assign(f, list, key)
+	default:
+		return fmt.Errorf("%s: can't be set from the command line", key)
+	}
+	return nil
+}
+
+// Encodes the struct v as TOML, nested structs become tables
+func encode(b *strings.Builder, v reflect.Value, prefix string) {
+	t := v.Type()
+	var tables []int
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("toml")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct && f.Type() != durationType {
+			tables = append(tables, i)
+			continue
+		}
+		if f.Kind() == reflect.Map {
+			if f.Len() > 0 {
+				tables = append(tables, i)
+			}
+			continue
+		}
+		fmt.Fprintf(b, "%s = %s\n", tag, encodeValue(f))
+	}
+	for _, i := range tables {
+		name := prefix + t.Field(i).Tag.Get("toml")
+		f := v.Field(i)
+		if f.Kind() == reflect.Map {
+			keys := f.MapKeys()
+			sort.Slice(keys, func(a, b int) bool { return keys[a].String() < keys[b].String() })
+			if f.Type().Elem().Kind() == reflect.Struct {
+				for _, k := range keys {
+					key := name + "." + encodeKey(k.String())
+					fmt.Fprintf(b, "\n[%s]\n", key)
+					encode(b, f.MapIndex(k), key+".")
+				}
+				continue
+			}
+			fmt.Fprintf(b, "\n[%s]\n", name)
+			for _, k := range keys {
+				fmt.Fprintf(b, "%s = %s\n", encodeKey(k.String()), encodeValue(f.MapIndex(k)))
+			}
+			continue
+		}
+		fmt.Fprintf(b, "\n[%s]\n", name)
+		encode(b, f, name+".")
+	}
+}
+
+// Quotes the map keys that aren't bare keys, e.g. containing dots or spaces
+func encodeKey(k string) string {
+	if k == "" {
+		return quote(k)
+	}
+	for _, r := range k {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return quote(k)
+		}
+	}
+	return k
+}
+
+func encodeValue(f reflect.Value) string {
+	if f.Type() == durationType {
+		return quote(time.Duration(f.Int()).String())
+	}
+	switch f.Kind() {
+	case reflect.String:
+		return quote(f.String())
+	case reflect.Int:
+		return strconv.FormatInt(f.Int(), 10)
+	case reflect.Bool:
+		return strconv.FormatBool(f.Bool())
+	case reflect.Slice:
+		items := make([]string, f.Len())
+		for i := range items {
+			items[i] = encodeValue(f.Index(i))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return quote(fmt.Sprint(f.Interface()))
+}
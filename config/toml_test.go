@@ -0,0 +1,72 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteReadRoundTrip(t *testing.T) {
+	c := Default()
+	c.Profile = "work"
+	c.Groups = map[string][]string{"my.grp": {"de", "fr"}, "plain": {"us"}, "a=b": {"it"}}
+	c.Isolation.Classes = map[string]IsolationClass{
+		"web browser": {Port: 9041, Users: []string{"alice"}},
+		"pkg":         {Port: 9042, DestPorts: []int{80, 443}}}
+	c.UDP.Allow = []string{"192.168.1.1:123"}
+	p := filepath.Join(t.TempDir(), "session.toml")
+	if err := c.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	back, err := Read(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.String() != c.String() {
+		t.Errorf("read back\n%s\nwritten\n%s", back, c)
+	}
+	if _, ok := back.Groups["my.grp"]; !ok {
+		t.Errorf("group my.grp lost: %v", back.Groups)
+	}
+	if _, ok := back.Groups["a=b"]; !ok {
+		t.Errorf("group a=b lost: %v", back.Groups)
+	}
+	if _, ok := back.Isolation.Classes["web browser"]; !ok {
+		t.Errorf("class web browser lost: %v", back.Isolation.Classes)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		// err is a substring of the expected error, empty when valid
+		err string
+	}{
+		{"quoted key with =", "[groups]\n\"a=b\" = [\"it\"]\n", ""},
+		{"dotted quoted key", "\"x.y\".'z=1' = 1\n", ""},
+		{"reopened implicit table", "[a.b]\nx = 1\n[a]\ny = 2\n", ""},
+		{"duplicate table", "[udp]\npolicy = \"drop\"\n[udp]\nallow = []\n", "line 3: duplicate table udp"},
+		{"duplicate dotted table", "[a.\"b c\"]\n[ a . \"b c\" ]\n", "line 2: duplicate table a.b c"},
+		{"duplicate key", "a = 1\na = 2\n", "line 2: duplicate key a"},
+		{"missing =", "a 1\n", "line 1: expected key = value"},
+		{"space in bare key", "a b = 1\n", "line 1: invalid key near"},
+		{"missing key", "= 1\n", "line 1: invalid key near"},
+		{"garbage after header key", "[a b]\n", "line 1: invalid key near"},
+	} {
+		_, err := parse([]byte(tc.data))
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: error %v, want %q", tc.name, err, tc.err)
+		}
+	}
+	tree, err := parse([]byte("\"x.y\".'z=1' = 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, ok := tree["x.y"].(map[string]interface{}); !ok || x["z=1"] != int64(1) {
+		t.Errorf("quoted keys parsed as %v", tree)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/multiversecoder/hidemego/config"
+	"github.com/multiversecoder/hidemego/tor"
+)
+
+func init() {
+	register(&command{
+		Name:  "countries",
+		Args:  "[@group|code...]",
+		Short: "List the country groups and the known country codes",
+		Long: `
+Without arguments lists the built-in country groups and the ones defined in
+the [groups] table of the configuration file, with their members. Groups
+defined in the configuration file replace the built-in ones.
+
+With arguments expands the given ISO 3166-1 codes and @groups as start does
+for the -exclude-countries and -exit-countries flags.`,
+		Examples: []string{
+			"hidemego countries",
+			"hidemego countries -codes",
+			"hidemego countries @14eyes ch"},
+		Flags: func(fs *flag.FlagSet) {
+			fs.String("config", config.DefaultPath, "Configuration file")
+			fs.Bool("codes", false, "List the ISO 3166-1 country codes")
+		},
+		Run: func(fs *flag.FlagSet) int {
+			f, err := config.OpenOrDefault(fs.Lookup("config").Value.String())
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitFailure
+			}
+			cfg, err := f.Config("")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitFailure
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			defer w.Flush()
+			if fs.Lookup("codes").Value.String() == "true" {
+				for _, c := range tor.Countries() {
+					fmt.Fprintf(w, "%s\t%s\n", c.Code, c.Name)
+				}
+				return exitOK
+			}
+			if fs.NArg() > 0 {
+				codes, err := tor.ExpandCountries(fs.Args(), cfg.Groups)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return exitFailure
+				}
+				for _, c := range codes {
+					name, _ := tor.CountryName(c)
+					fmt.Fprintf(w, "%s\t%s\n", c, name)
+				}
+				return exitOK
+			}
+			sources := map[string]string{}
+			for name := range tor.Groups {
+				sources[name] = "built-in"
+			}
+			for name := range cfg.Groups {
+				sources[name] = f.Path
+			}
+			names := make([]string, 0, len(sources))
+			for name := range sources {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				codes, err := tor.ExpandCountries([]string{"@" + name}, cfg.Groups)
+				if err != nil {
+					fmt.Fprintf(w, "@%s\t%s\t%v\n", name, sources[name], err)
+					continue
+				}
+				fmt.Fprintf(w, "@%s\t%s\t%s\n", name, sources[name], strings.Join(codes, ","))
+			}
+			return exitOK
+		}})
+}
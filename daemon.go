@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/multiversecoder/hidemego/config"
+	"github.com/multiversecoder/hidemego/linux"
+	"github.com/multiversecoder/hidemego/systemd"
+	"github.com/multiversecoder/hidemego/tools"
+	"github.com/multiversecoder/hidemego/tor"
+)
+
+// socketFile is the Unix socket of the daemon API
+var socketFile = path.Join("/", "run", "hidemego", "hidemego.sock")
+
+const (
+	// apiTimeout bounds the time a client takes to send its request and to
+	// read the reply
+	apiTimeout = 10 * time.Second
+	// maxAPIRequest is the size limit of a request
+	maxAPIRequest = 64 << 10
+)
+
+// apiRequest is a daemon API request, one JSON object per connection
+type apiRequest struct {
+	// Command is one of status, new, reload and stop
+	Command string `json:"command"`
+}
+
+// apiResponse is the reply to an apiRequest
+type apiResponse struct {
+	OK     bool          `json:"ok"`
+	Error  string        `json:"error,omitempty"`
+	Status *daemonStatus `json:"status,omitempty"`
+	Exit   *tor.Relay    `json:"exit,omitempty"`
+}
+
+// daemonStatus is the state reported by the status request
+type daemonStatus struct {
+	PID     int       `json:"pid"`
+	Since   time.Time `json:"since"`
+	Profile string    `json:"profile,omitempty"`
+	// Tor is the ActiveState of the tor unit
+	Tor    string `json:"tor"`
+	TorPID int    `json:"tor_pid,omitempty"`
+	// Exit is the exit node selected by the last new request
+	Exit *tor.Relay `json:"exit,omitempty"`
+	// Drift lists what the last check found changed
+	Drift     []string  `json:"drift,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+	// FailedClosed is set when the session couldn't be restored and all
+	// the traffic is blocked
+	FailedClosed bool `json:"failed_closed"`
+	// UDPPolicy is the udp.policy of the session and UDP the counters of
+	// its rules
+	UDPPolicy string          `json:"udp_policy"`
+	UDP       []linux.Counter `json:"udp,omitempty"`
+	// TimeSync is the time of the last clock synchronization and
+	// ClockOffset the offset it found
+	TimeSync    time.Time `json:"time_sync"`
+	ClockOffset string    `json:"clock_offset,omitempty"`
+	// HTTPProxy and SOCKSProxy are the addresses of the local proxies
+	HTTPProxy  string `json:"http_proxy,omitempty"`
+	SOCKSProxy string `json:"socks_proxy,omitempty"`
+}
+
+// daemon is a running hidemego session
+type daemon struct {
+	fs *flag.FlagSet
+	// act serializes the actions changing the session
+	act sync.Mutex
+	cfg config.Config
+	rc  tor.RC
+	// state is the system state the session applied
+	state linux.State
+	// stopped is set once the session is reverted, stopErr is the error
+	// of the revert
+	stopped bool
+	stopErr error
+	// mu guards status
+	mu     sync.Mutex
+	status daemonStatus
+	// ctx is canceled when the daemon stops
+	ctx    context.Context
+	cancel context.CancelFunc
+	// proxy relays the clients of the local proxies to tor
+	proxy tor.FrontEnd
+	// httpProxy and socksProxy are the listeners of the local proxies, nil
+	// when disabled
+	httpProxy  net.Listener
+	socksProxy net.Listener
+	// rotation receives the identity.rotate_every of a reloaded
+	// configuration
+	rotation chan time.Duration
+}
+
+func init() {
+	register(&command{
+		Name:  "daemon",
+		Short: "Anonymize the system and keep watching the session",
+		Long: `
+Starts a hidemego session like start, then stays resident. Every -watch
+interval, and as soon as resolv.conf or a network interface changes, the
+daemon checks that Tor is running and compares the firewall rules,
+resolv.conf, the MAC addresses and the hardened sysctls with the state
+recorded when the session started. What drifted is logged and, depending on
+-on-drift, re-applied (reapply) or all the traffic is blocked (killswitch).
+When the session can't be restored all the traffic is blocked (fail closed).
+
+The daemon is controlled through a Unix socket accepting one JSON request per
+connection, e.g. {"command": "status"}. The commands are:
+
+  status  report the daemon, Tor and drift state
+  new     change the Tor identity, like 'hidemego new'
+  reload  re-read the configuration and re-apply torrc and firewall rules
+  stop    revert the session and exit, like 'hidemego stop'
+
+SIGHUP reloads the configuration, SIGINT and SIGTERM stop the session. With
+identity.rotate_every set the daemon rotates the identity like 'hidemego
+rotate'. With time_sync.enabled it sets the clock every
+time_sync.interval like 'hidemego timesync'.
+
+With -http-proxy or -socks-proxy the daemon also runs an HTTP CONNECT or a
+SOCKS5 proxy on a loopback address, relaying to the Tor SocksAuthPort. The
+user:password of a client is passed on to Tor, so that every credential gets
+its own circuits, also for the programs that only speak HTTP.
+-proxy-credentials restricts the clients to the listed credentials.`,
+		Examples: []string{
+			"hidemego daemon",
+			"hidemego daemon -profile=paranoid -watch=5s",
+			"hidemego daemon -on-drift=killswitch",
+			"hidemego daemon -http-proxy=127.0.0.1:8118 -socks-proxy=127.0.0.1:1080",
+			"hidemego status"},
+		Root: true,
+		Flags: func(fs *flag.FlagSet) {
+			sessionFlags(fs)
+			fs.String("socket", socketFile, "Unix socket of the daemon API")
+			fs.Duration("watch", 0, "Interval between two session checks (default: the session watch.interval)")
+			fs.String("on-drift", "", "reapply or killswitch (default: the session watch.on_drift)")
+			fs.String("http-proxy", "", "Loopback address of the HTTP CONNECT proxy relaying to Tor (e.g. 127.0.0.1:8118)")
+			fs.String("socks-proxy", "", "Loopback address of the SOCKS5 proxy relaying to Tor (e.g. 127.0.0.1:1080)")
+			fs.String("proxy-credentials", "", "File with the user:password lines accepted by the local proxies")
+		},
+		Run: runDaemon})
+}
+
+func runDaemon(fs *flag.FlagSet) int {
+	cfg, err := sessionConfig(fs)
+	if err != nil {
+		logger.Println("Invalid Configuration:", err)
+		return exitFailure
+	}
+	socket := fs.Lookup("socket").Value.String()
+	// listen first so that a running daemon is never replaced
+	l, err := listen(socket)
+	if err != nil {
+		logger.Println("Can't Listen on", socket+":", err)
+		return exitFailure
+	}
+	defer os.Remove(socket)
+	d := &daemon{
+		fs: fs,
+		status: daemonStatus{
+			PID:   os.Getpid(),
+			Since: time.Now()}}
+	// the proxies are bound before the session changes the system
+	if err := d.listenProxies(cfg); err != nil {
+		logger.Println("Can't Start the Local Proxies:", err)
+		return exitFailure
+	}
+	defer d.closeProxies()
+	cfg = prepare(cfg)
+	d.cfg = cfg
+	d.status.Profile = cfg.Profile
+	d.status.UDPPolicy = cfg.UDP.Policy
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.rotation = make(chan time.Duration, 1)
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	d.rc, d.state = setup(cfg)
+	logger.Println("Hidemego Daemon Listening on", socket)
+	go d.serve(l)
+	d.serveProxies()
+	go d.watch()
+	go d.rotate()
+	if cfg.TimeSync.Enabled {
+		go d.syncClock()
+	}
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				if err := d.reload(); err != nil {
+					logger.Println("Can't Reload the Configuration:", err)
+				}
+				continue
+			}
+			logger.Println("Caught:", sig)
+			d.stop()
+			d.cancel()
+		case <-d.ctx.Done():
+		}
+		// the stop request cancels the daemon after a failed revert too
+		d.act.Lock()
+		defer d.act.Unlock()
+		if d.stopErr != nil {
+			return exitFailure
+		}
+		return exitOK
+	}
+}
+
+// Listens on the Unix socket, replacing a stale socket file
+func listen(socket string) (net.Listener, error) {
+	if err := os.MkdirAll(path.Dir(socket), 0700); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(socket); err == nil {
+		if c, err := net.Dial("unix", socket); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("the hidemego daemon is already running")
+		}
+		os.Remove(socket)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (d *daemon) serve(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			select {
+			case <-d.ctx.Done():
+				return
+			default:
+			}
+			logger.Println("Can't Accept API Connection:", err)
+			continue
+		}
+		go d.handle(c)
+	}
+}
+
+func (d *daemon) handle(c net.Conn) {
+	defer c.Close()
+	var req apiRequest
+	var rsp apiResponse
+	c.SetDeadline(time.Now().Add(apiTimeout))
+	line, err := bufio.NewReader(io.LimitReader(c, maxAPIRequest)).ReadBytes('\n')
+	if len(line) >= maxAPIRequest {
+		err = fmt.Errorf("larger than %d bytes", maxAPIRequest)
+	} else if err == nil || len(line) > 0 {
+		err = json.Unmarshal(line, &req)
+	}
+	if err != nil {
+		rsp.Error = fmt.Sprintf("invalid request: %v", err)
+		json.NewEncoder(c).Encode(rsp)
+		return
+	}
+	// a command may take minutes, e.g. stop, only the reply is bounded
+	c.SetDeadline(time.Time{})
+	switch req.Command {
+	case "status":
+		s := d.snapshot()
+		rsp.Status = &s
+	case "new":
+		// the session lock isn't held while waiting for the new exit, that
+		// would delay stop, reload and the drift checks
+		d.act.Lock()
+		stopped, cfg := d.stopped, d.cfg
+		d.act.Unlock()
+		var exit tor.Relay
+		if stopped {
+			err = fmt.Errorf("the session is stopped")
+		} else {
+			exit, err = newIdentity(cfg, time.Minute)
+		}
+		if err == nil {
+			logExit(exit)
+			d.mu.Lock()
+			d.status.Exit = &exit
+			d.mu.Unlock()
+			rsp.Exit = &exit
+		}
+	case "reload":
+		err = d.reload()
+	case "stop":
+		// the session is reverted before replying, the daemon exits after
+		err = d.stop()
+		defer d.cancel()
+	default:
+		err = fmt.Errorf("unknown command %q", req.Command)
+	}
+	if err != nil {
+		rsp.Error = err.Error()
+	}
+	rsp.OK = err == nil
+	c.SetWriteDeadline(time.Now().Add(apiTimeout))
+	json.NewEncoder(c).Encode(rsp)
+}
+
+// Returns a copy of the daemon status with the current tor state
+func (d *daemon) snapshot() daemonStatus {
+	d.mu.Lock()
+	s := d.status
+	s.Drift = append([]string(nil), d.status.Drift...)
+	d.mu.Unlock()
+	if state, err := systemd.System.State(tor.ServiceName); err == nil {
+		s.Tor = state.ActiveState
+	} else {
+		s.Tor = "unknown"
+	}
+	s.TorPID, _ = tor.MainPID()
+	s.UDP, _ = linux.UDPCounters()
+	return s
+}
+
+// Reverts the session, the daemon exits when its context is canceled. The
+// session is marked stopped even when the revert fails, so that it is not
+// re-applied, and 'hidemego stop' can retry once the daemon exited.
+func (d *daemon) stop() error {
+	d.act.Lock()
+	defer d.act.Unlock()
+	if d.stopped {
+		return d.stopErr
+	}
+	d.stopped = true
+	once.Do(func() {
+		d.stopErr = revert()
+	})
+	if d.stopErr != nil {
+		logger.Println("Can't Revert the Session:", d.stopErr)
+	}
+	return d.stopErr
+}
+
+// Re-reads the configuration and re-applies the torrc and the firewall rules
+func (d *daemon) reload() error {
+	d.act.Lock()
+	defer d.act.Unlock()
+	if d.stopped {
+		return fmt.Errorf("the session is stopped")
+	}
+	cfg, err := sessionConfig(d.fs)
+	if err != nil {
+		return err
+	}
+	// keep the detected tor user
+	if cfg.Tor.ID == 0 {
+		cfg.Tor.ID = d.cfg.Tor.ID
+	}
+	if cfg.Tor.User == "" {
+		cfg.Tor.User = d.cfg.Tor.User
+	}
+	if cfg.Gateway.Iface != d.cfg.Gateway.Iface {
+		return fmt.Errorf("gateway.iface can't change while the session is running")
+	}
+	if cfg.LocalProxy.HTTP != d.cfg.LocalProxy.HTTP || cfg.LocalProxy.SOCKS != d.cfg.LocalProxy.SOCKS {
+		return fmt.Errorf("local_proxy can't change while the session is running")
+	}
+	if cfg.LocalProxy.Enabled() && cfg.Tor.SocksAuthPort != d.cfg.Tor.SocksAuthPort {
+		return fmt.Errorf("tor.socks_auth_port can't change while the local proxies are running")
+	}
+	users, err := proxyUsers(cfg)
+	if err != nil {
+		return err
+	}
+	logger.Println("Reloading the Configuration")
+	rc, err := torRC(cfg)
+	if err != nil {
+		return err
+	}
+	if err := tor.SetTorRC(rc); err != nil {
+		return fmt.Errorf("can't setup the hidemego torrc: %v", err)
+	}
+	if err := tor.Reload(); err != nil {
+		return fmt.Errorf("can't reload tor: %v", err)
+	}
+	if err := linux.SetIPTablesRules(firewall(cfg, rc)); err != nil {
+		return fmt.Errorf("can't setup the iptables rules: %v", err)
+	}
+	if err := saveSession(cfg); err != nil {
+		return err
+	}
+	if err := d.rerecord(); err != nil {
+		return fmt.Errorf("can't record the session state: %v", err)
+	}
+	if cfg.Identity.RotateEvery != d.cfg.Identity.RotateEvery {
+		// only reload sends, under d.act, so the send never blocks
+		select {
+		case <-d.rotation:
+		default:
+		}
+		d.rotation <- cfg.Identity.RotateEvery
+	}
+	d.cfg, d.rc = cfg, rc
+	d.proxy.SetUsers(users)
+	d.mu.Lock()
+	d.status.Profile = cfg.Profile
+	d.status.UDPPolicy = cfg.UDP.Policy
+	d.status.FailedClosed = false
+	d.mu.Unlock()
+	return nil
+}
+
+// Reads the credentials accepted by the local proxies, nil when any are
+// accepted
+func proxyUsers(cfg config.Config) (map[string]string, error) {
+	if cfg.LocalProxy.CredentialsFile == "" {
+		return nil, nil
+	}
+	users, err := tor.ReadProxyUsers(cfg.LocalProxy.CredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("local_proxy.credentials_file: %v", err)
+	}
+	return users, nil
+}
+
+// Binds the listeners of the local proxies
+func (d *daemon) listenProxies(cfg config.Config) error {
+	users, err := proxyUsers(cfg)
+	if err != nil {
+		return err
+	}
+	d.proxy.SocksAddr = socksAuthAddr(cfg)
+	d.proxy.Log = logger.Println
+	d.proxy.SetUsers(users)
+	if cfg.LocalProxy.HTTP != "" {
+		if d.httpProxy, err = net.Listen("tcp", cfg.LocalProxy.HTTP); err != nil {
+			return err
+		}
+	}
+	if cfg.LocalProxy.SOCKS != "" {
+		if d.socksProxy, err = net.Listen("tcp", cfg.LocalProxy.SOCKS); err != nil {
+			d.closeProxies()
+			return err
+		}
+	}
+	return nil
+}
+
+// Accepts the clients of the local proxies until they are closed
+func (d *daemon) serveProxies() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.httpProxy != nil {
+		d.status.HTTPProxy = d.httpProxy.Addr().String()
+		logger.Println("HTTP CONNECT Proxy Listening on", d.status.HTTPProxy)
+		go d.proxy.ServeConnect(d.httpProxy)
+	}
+	if d.socksProxy != nil {
+		d.status.SOCKSProxy = d.socksProxy.Addr().String()
+		logger.Println("SOCKS5 Proxy Listening on", d.status.SOCKSProxy)
+		go d.proxy.ServeSOCKS(d.socksProxy)
+	}
+}
+
+func (d *daemon) closeProxies() {
+	if d.httpProxy != nil {
+		d.httpProxy.Close()
+	}
+	if d.socksProxy != nil {
+		d.socksProxy.Close()
+	}
+}
+
+// Checks the session every watch.interval and on resolv.conf and network
+// interface events
+func (d *daemon) watch() {
+	d.act.Lock()
+	every, watchEvents := d.cfg.Watch.Interval, d.cfg.Watch.Events
+	d.act.Unlock()
+	events := make(chan string, 1)
+	if watchEvents {
+		if err := linux.Events(events); err != nil {
+			logger.Println("Can't Watch Network Events, Checking Every", every.String()+":", err)
+		}
+	}
+	t := time.NewTimer(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case e := <-events:
+			// let the program changing the system finish
+			time.Sleep(time.Second)
+			logger.Println("Checking the Session After a Change of", e)
+		case <-t.C:
+		}
+		d.check()
+		d.act.Lock()
+		every = d.cfg.Watch.Interval
+		d.act.Unlock()
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		t.Reset(every)
+	}
+}
+
+// Compares the live state with the session, then re-applies what drifted or
+// blocks all the traffic according to watch.on_drift. The daemon fails
+// closed when the session can't be restored.
+func (d *daemon) check() {
+	d.act.Lock()
+	defer d.act.Unlock()
+	if d.stopped {
+		return
+	}
+	var drifted, failed []string
+	if state, err := systemd.System.State(tor.ServiceName); err != nil || state.ActiveState != "active" {
+		drifted = append(drifted, "tor")
+		logger.Println("Tor Is Not Running, Restarting Tor Service")
+		if err := tor.Restart(); err != nil {
+			logger.Println("Can't Restart Tor Service:", err)
+			failed = append(failed, "tor")
+		}
+	}
+	drift, err := d.state.Compare()
+	if err != nil {
+		logger.Println("Can't Compare the Session State:", err)
+		failed = append(failed, "state")
+	}
+	for _, dr := range drift {
+		drifted = append(drifted, dr.String())
+		logDrift(dr)
+	}
+	d.mu.Lock()
+	closed := d.status.FailedClosed
+	d.mu.Unlock()
+	if len(drift) > 0 && d.cfg.Watch.OnDrift == "killswitch" && !closed {
+		var names []string
+		for _, dr := range drift {
+			names = append(names, dr.String())
+		}
+		d.failClosed("Session Drifted (" + strings.Join(names, ", ") + ")")
+		drift = nil
+	}
+	for _, dr := range drift {
+		if err := d.reapply(dr, closed); err != nil {
+			logger.Println("Can't Restore", dr.String()+":", err)
+			failed = append(failed, dr.String())
+		}
+	}
+	if len(drift) > 0 {
+		if err := d.rerecord(); err != nil {
+			logger.Println("Can't Record the Session State:", err)
+		}
+	}
+	d.mu.Lock()
+	d.status.LastCheck = time.Now()
+	if len(drifted) > 0 {
+		d.status.Drift = drifted
+	}
+	closed = d.status.FailedClosed
+	d.mu.Unlock()
+	if len(failed) > 0 && !closed {
+		d.failClosed("Can't Restore " + strings.Join(failed, ", "))
+	}
+}
+
+// Logs what drifted from the session state
+func logDrift(dr linux.Drift) {
+	switch dr.Kind {
+	case "firewall":
+		logger.Println("Firewall Rules Changed:")
+		for _, r := range dr.Diff {
+			logger.Println("  ", r)
+		}
+	case "resolv.conf":
+		logger.Println("resolv.conf Changed")
+	case "mac":
+		logger.Printf("MAC Address of %s Changed from %s to %s\n", dr.Name, dr.Want, dr.Got)
+	case "sysctl":
+		logger.Printf("Kernel Setting %s Changed from %s to %s\n", dr.Name, dr.Want, dr.Got)
+	}
+}
+
+// Restores the state that drifted, the firewall of a failed closed session
+// is restored blocking all the traffic again
+func (d *daemon) reapply(dr linux.Drift, closed bool) error {
+	switch dr.Kind {
+	case "firewall":
+		if closed {
+			logger.Println("Blocking All Traffic Again")
+			return linux.KillSwitch()
+		}
+		logger.Println("Restoring IPTables Rules")
+		return linux.SetIPTablesRules(firewall(d.cfg, d.rc))
+	case "resolv.conf":
+		logger.Println("Restoring resolv.conf")
+		return linux.SetResolvConf()
+	case "mac":
+		logger.Println("Assigning", dr.Want, "to", dr.Name)
+		if err := linux.IPSet(dr.Name, "down"); err != nil {
+			return err
+		}
+		if err := linux.IPSetMACAddr(dr.Name, dr.Want); err != nil {
+			return err
+		}
+		return linux.IPSet(dr.Name, "up")
+	case "sysctl":
+		logger.Println("Restoring Kernel Setting", dr.Name)
+		if err := tools.SetSysctl(dr.Name + "=" + dr.Want); err != nil {
+			return err
+		}
+		if v, err := linux.SysctlValue(dr.Name); err != nil || v != dr.Want {
+			return fmt.Errorf("%s is still %s", dr.Name, v)
+		}
+		// writing ip_forward resets the forwarding of every iface
+		if dr.Name == "net.ipv4.ip_forward" && d.cfg.Gateway.Iface != "" {
+			logger.Println("Enabling Forwarding on", d.cfg.Gateway.Iface)
+			return linux.EnableForwarding(d.cfg.Gateway.Iface)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown drift %s", dr.Kind)
+}
+
+// Records the live firewall rules and resolv.conf as the session state,
+// the MAC addresses and the sysctls keep their assigned values
+func (d *daemon) rerecord() error {
+	st, err := linux.Snapshot(nil, nil)
+	if err != nil {
+		return err
+	}
+	d.state.Firewall, d.state.ResolvConf = st.Firewall, st.ResolvConf
+	return saveState(d.state)
+}
+
+// Blocks all the traffic until the session is reloaded or stopped
+func (d *daemon) failClosed(reason string) {
+	logger.Println(reason + ", Blocking All Traffic")
+	if err := linux.KillSwitch(); err != nil {
+		logger.Println("Can't Block the Traffic:", err)
+		return
+	}
+	d.mu.Lock()
+	d.status.FailedClosed = true
+	d.mu.Unlock()
+	// the blocking rules are the firewall to keep from now on
+	if err := d.rerecord(); err != nil {
+		logger.Println("Can't Record the Session State:", err)
+	}
+}
+
+// Changes the identity every identity.rotate_every, the interval of a
+// reloaded configuration is received from d.rotation
+func (d *daemon) rotate() {
+	d.act.Lock()
+	every := d.cfg.Identity.RotateEvery
+	d.act.Unlock()
+	var ip string
+	t := time.NewTicker(time.Hour)
+	t.Stop()
+	defer t.Stop()
+	for {
+		if every > 0 {
+			t.Reset(every)
+			if ip == "" {
+				d.act.Lock()
+				socks := socksAuthAddr(d.cfg)
+				d.act.Unlock()
+				ip, _ = tor.ExitIP(socks, time.Minute)
+			}
+		} else {
+			t.Stop()
+		}
+		select {
+		case <-d.ctx.Done():
+			return
+		case every = <-d.rotation:
+		case <-t.C:
+			// like syncClock, the lock isn't held while rotating
+			d.act.Lock()
+			stopped, cfg := d.stopped, d.cfg
+			d.act.Unlock()
+			if !stopped {
+				ip, _ = rotate(cfg, ip)
+			}
+		}
+	}
+}
+
+// Sets the clock now and every time_sync.interval
+func (d *daemon) syncClock() {
+	t := time.NewTicker(d.cfg.TimeSync.Interval)
+	defer t.Stop()
+	for {
+		// the session lock isn't held while waiting for the sources, that
+		// would delay stop
+		d.act.Lock()
+		stopped, cfg := d.stopped, d.cfg
+		d.act.Unlock()
+		if !stopped {
+			if offset, err := syncClock(cfg, false); err == nil {
+				d.mu.Lock()
+				d.status.TimeSync = time.Now()
+				d.status.ClockOffset = offset.String()
+				d.mu.Unlock()
+			}
+		}
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Sends a request to the daemon listening on socket
+func daemonCall(socket, command string) (apiResponse, error) {
+	var rsp apiResponse
+	c, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return rsp, err
+	}
+	defer c.Close()
+	// stop reverts the whole session before replying
+	c.SetDeadline(time.Now().Add(5 * time.Minute))
+	if err := json.NewEncoder(c).Encode(apiRequest{Command: command}); err != nil {
+		return rsp, err
+	}
+	if err := json.NewDecoder(c).Decode(&rsp); err != nil {
+		return rsp, fmt.Errorf("no reply from the daemon: %v", err)
+	}
+	if !rsp.OK {
+		return rsp, fmt.Errorf("%s", rsp.Error)
+	}
+	return rsp, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/multiversecoder/hidemego/linux"
+	"github.com/multiversecoder/hidemego/tor"
+)
+
+var (
+	// execTorRC and execLib are the torrc and the data directory of the
+	// tor process run by exec, the directory is kept to bootstrap faster
+	execTorRC = path.Join("/", "run", "hidemego", "exec.torrc")
+	execLib   = path.Join("/", "var", "lib", "tor", "hidemego-exec")
+)
+
+func init() {
+	register(&command{
+		Name:  "exec",
+		Args:  "[--] command [args...]",
+		Short: "Run a single command with all its traffic routed through Tor",
+		Long: `
+Runs a command in a network namespace whose traffic goes through Tor, the
+rest of the system is not anonymized. hidemego starts a dedicated Tor
+process with the torrc settings of start (node selection, bridges, upstream
+proxy), creates a network namespace connected to the host by a veth pair and
+redirects the TCP and DNS traffic of the namespace to the Tor TransPort and
+DNSPort. Any other traffic is dropped.
+
+The command runs as the user who invoked sudo, -as-root keeps the root
+privileges. When it exits the namespace, the firewall rules and Tor are
+removed and hidemego exits with the command exit status.`,
+		Examples: []string{
+			"hidemego exec -- curl https://check.torproject.org/api/ip",
+			"hidemego exec -exit-countries=ch -- firefox --new-instance",
+			"hidemego exec -as-root -- apt-get update"},
+		Root: true,
+		Flags: func(fs *flag.FlagSet) {
+			torFlags(fs)
+			fs.Bool("as-root", false, "Run the command as root instead of the user who invoked sudo")
+			fs.Duration("timeout", 3*time.Minute, "Time to wait for Tor to bootstrap")
+		},
+		Run: runExec})
+}
+
+func runExec(fs *flag.FlagSet) int {
+	args := fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	cfg, err := sessionConfig(fs)
+	if err != nil {
+		logger.Println("Invalid Configuration:", err)
+		return exitFailure
+	}
+	if cfg.Tor.User == "" {
+		if cfg.Tor.User, err = tor.Usr(); err != nil {
+			logger.Println("Can't Automatically Detect Tor User:", err)
+			return exitFailure
+		}
+	}
+	if !fs.Lookup("as-root").Value.(flag.Getter).Get().(bool) {
+		if args, err = dropPrivileges(args); err != nil {
+			logger.Println("Can't Run the Command as the Invoking User:", err)
+			return exitFailure
+		}
+	}
+	ns := linux.ExecNetns
+	if ns.Exists() {
+		if pids, _ := ns.PIDs(); len(pids) > 0 {
+			logger.Println("Another hidemego exec is running")
+			return exitFailure
+		}
+		logger.Println("Removing the Stale", ns.Name, "Network Namespace")
+		ns.Remove()
+	}
+
+	// the tor of exec serves only the namespace
+	cfg.Gateway.Iface = ""
+	cfg.Containers.Networks = nil
+	rc, err := torRC(cfg)
+	if err != nil {
+		logger.Println("Can't Setup Hidemego TorRC:", err)
+		return exitFailure
+	}
+	rc.ListenAddr = ns.HostIP
+	rc.Onions, rc.IsolatedPorts = nil, nil
+	rc.SocksDestPort, rc.SocksAuthPort, rc.ControlPort = 0, 0, 0
+	if err := os.MkdirAll(path.Dir(execTorRC), 0755); err != nil {
+		logger.Println("Can't Create", path.Dir(execTorRC)+":", err)
+		return exitFailure
+	}
+	if err := tor.WriteTorRC(rc, execTorRC, execLib); err != nil {
+		logger.Println("Can't Setup Hidemego TorRC:", err)
+		return exitFailure
+	}
+	defer os.Remove(execTorRC)
+
+	logger.Println("Creating the", ns.Name, "Network Namespace")
+	if err := ns.Create(cfg.Tor.TransPort, cfg.Tor.DNSPort); err != nil {
+		logger.Println("Can't Create the Network Namespace:", err)
+		ns.Remove()
+		return exitFailure
+	}
+	defer func() {
+		logger.Println("Removing the", ns.Name, "Network Namespace")
+		if err := ns.Remove(); err != nil {
+			logger.Println("Can't Remove the Network Namespace:", err)
+		}
+	}()
+
+	// tor binds the host end of the veth pair, so it starts after it
+	logger.Println("Starting Tor")
+	timeout := fs.Lookup("timeout").Value.(flag.Getter).Get().(time.Duration)
+	t, err := tor.StartInstance(execTorRC, timeout, func(msg string) {
+		logger.Println(msg)
+	})
+	if err != nil {
+		logger.Println("Can't Start Tor:", err)
+		return exitFailure
+	}
+	defer t.Stop()
+
+	cmd := ns.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// the command gets the terminal signals, hidemego waits for it to exit
+	signal.Ignore(os.Interrupt, syscall.SIGQUIT)
+	defer signal.Reset(os.Interrupt, syscall.SIGQUIT)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	if err := cmd.Start(); err != nil {
+		logger.Println("Can't Run", args[0]+":", err)
+		return exitFailure
+	}
+	go func() {
+		for sig := range sigs {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	if err := cmd.Wait(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			if code := e.ExitCode(); code >= 0 {
+				return code
+			}
+			// killed by a signal
+			return 128 + int(e.Sys().(syscall.WaitStatus).Signal())
+		}
+		logger.Println("Can't Run", args[0]+":", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// Prepends to args the setpriv command switching to the user who invoked
+// sudo, args are left as they are when hidemego wasn't run through sudo
+func dropPrivileges(args []string) ([]string, error) {
+	name := os.Getenv("SUDO_USER")
+	if name == "" || name == "root" {
+		return args, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath("setpriv"); err != nil {
+		return nil, fmt.Errorf("setpriv is not installed, use -as-root")
+	}
+	env := []string{"env", "HOME=" + u.HomeDir, "USER=" + u.Username, "LOGNAME=" + u.Username}
+	priv := []string{"setpriv", "--reuid=" + u.Uid, "--regid=" + u.Gid, "--init-groups", "--"}
+	return append(append(priv, env...), args...), nil
+}
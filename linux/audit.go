@@ -0,0 +1,379 @@
+package linux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/multiversecoder/hidemego/tools"
+)
+
+var (
+	// DropPrefix starts the log lines of the packets dropped by the final
+	// rule of the firewall
+	DropPrefix = "hidemego-drop"
+	// UDPPrefix is the NFLOG prefix of the udp log policy
+	UDPPrefix            = "hidemego-udp"
+	journalctlCommand, _ = tools.Which("journalctl")
+)
+
+// nfnetlink_log constants, missing from syscall
+const (
+	nfnlSubsysULog   = 4
+	nfulnlMsgPacket  = 0
+	nfulnlMsgConfig  = 1
+	nfulaCfgCmd      = 1
+	nfulaCfgMode     = 2
+	nfulnlCmdBind    = 1
+	nfulnlCmdPFBind  = 3
+	nfulnlCopyPacket = 2
+	nfulaPayload     = 9
+	nfulaPrefix      = 10
+	nfulaUID         = 11
+	nfulaGID         = 14
+)
+
+// Blocked is a packet dropped by the hidemego firewall
+type Blocked struct {
+	Time time.Time
+	// Prefix is DropPrefix or UDPPrefix
+	Prefix string
+	// UID and GID own the socket that sent the packet, -1 when unknown
+	UID, GID int
+	// Proto is TCP, UDP, ICMP or the IP protocol number
+	Proto string
+	Src   string
+	Dst   string
+	// SPort and DPort are zero for the protocols without ports
+	SPort, DPort int
+	// Process is the command name of the program that sent the packet,
+	// empty when unknown
+	Process string
+}
+
+// Returns the destination as address:port, or the address alone for the
+// protocols without ports
+func (b Blocked) Destination() string {
+	if b.DPort == 0 {
+		return b.Dst
+	}
+	return net.JoinHostPort(b.Dst, strconv.Itoa(b.DPort))
+}
+
+// Reads the packets logged by the LOG rule of the firewall from the kernel
+// log, since the given time
+func KernelBlocked(since time.Time) ([]Blocked, error) {
+	if journalctlCommand == "" {
+		return nil, fmt.Errorf("journalctl not found")
+	}
+	// --grep is missing from the journalctl builds without pcre2
+	out, err := exec.Command(journalctlCommand, "-k", "-q", "--no-pager", "-o", "short-unix",
+		"--since", since.Format("2006-01-02 15:04:05")).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path.Base(journalctlCommand), err)
+	}
+	var blocked []Blocked
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if b, ok := parseLogLine(sc.Text()); ok {
+			blocked = append(blocked, b)
+		}
+	}
+	return blocked, sc.Err()
+}
+
+// Parses a kernel log line written by the LOG target, e.g.
+// "1697712345.123456 host kernel: hidemego-drop: IN= OUT=eth0 SRC=... UID=1000"
+func parseLogLine(line string) (Blocked, bool) {
+	b := Blocked{Prefix: DropPrefix, UID: -1, GID: -1}
+	i := strings.Index(line, DropPrefix+":")
+	if i < 0 {
+		return b, false
+	}
+	if f := strings.Fields(line[:i]); len(f) > 0 {
+		if ts, err := strconv.ParseFloat(f[0], 64); err == nil {
+			sec := int64(ts)
+			b.Time = time.Unix(sec, int64((ts-float64(sec))*1e9))
+		}
+	}
+	for _, kv := range strings.Fields(line[i+len(DropPrefix)+1:]) {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			continue
+		}
+		switch p[0] {
+		case "SRC":
+			b.Src = p[1]
+		case "DST":
+			b.Dst = p[1]
+		case "PROTO":
+			b.Proto = p[1]
+		case "SPT":
+			b.SPort, _ = strconv.Atoi(p[1])
+		case "DPT":
+			b.DPort, _ = strconv.Atoi(p[1])
+		case "UID":
+			b.UID, _ = strconv.Atoi(p[1])
+		case "GID":
+			b.GID, _ = strconv.Atoi(p[1])
+		}
+	}
+	return b, b.Dst != ""
+}
+
+// Receives the packets logged to the NFLOG group and sends the ones logged
+// by hidemego on blocked until stop is closed. The group can have a single
+// listener, e.g. ulogd must not be bound to it.
+func NFLogBlocked(group int, blocked chan<- Blocked, stop <-chan struct{}) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	// the kernels before 3.17 need the nfnetlink_log logger bound to the
+	// family, the newer ones ignore the command
+	nflogConfig(fd, syscall.AF_INET, 0, nflogAttr(nfulaCfgCmd, []byte{nfulnlCmdPFBind}))
+	if err := nflogConfig(fd, syscall.AF_UNSPEC, group, nflogAttr(nfulaCfgCmd, []byte{nfulnlCmdBind})); err != nil {
+		return fmt.Errorf("can't bind NFLOG group %d: %v", group, err)
+	}
+	// copy the headers of the packet, 128 bytes are enough for IP and TCP
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, 128)
+	mode[4] = nfulnlCopyPacket
+	if err := nflogConfig(fd, syscall.AF_UNSPEC, group, nflogAttr(nfulaCfgMode, mode)); err != nil {
+		return fmt.Errorf("can't configure NFLOG group %d: %v", group, err)
+	}
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return err
+	}
+	buf := make([]byte, 65536)
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EINTR || err == syscall.EAGAIN || err == syscall.ENOBUFS {
+				continue
+			}
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			if m.Header.Type != nfnlSubsysULog<<8|nfulnlMsgPacket || len(m.Data) < 4 {
+				continue
+			}
+			if b, ok := parseNFLog(m.Data[4:]); ok {
+				select {
+				case blocked <- b:
+				case <-stop:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// Returns a netlink attribute
+func nflogAttr(typ uint16, data []byte) []byte {
+	a := make([]byte, 4, 4+len(data)+3)
+	binary.LittleEndian.PutUint16(a, uint16(4+len(data)))
+	binary.LittleEndian.PutUint16(a[2:], typ)
+	a = append(a, data...)
+	for len(a)%4 != 0 {
+		a = append(a, 0)
+	}
+	return a
+}
+
+// Sends a nfnetlink_log configuration message and waits for its ack
+func nflogConfig(fd int, family uint8, group int, attrs []byte) error {
+	b := make([]byte, syscall.NLMSG_HDRLEN+4, syscall.NLMSG_HDRLEN+4+len(attrs))
+	b = append(b, attrs...)
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	binary.LittleEndian.PutUint16(b[4:], nfnlSubsysULog<<8|nfulnlMsgConfig)
+	binary.LittleEndian.PutUint16(b[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	binary.LittleEndian.PutUint32(b[8:], uint32(time.Now().UnixNano()))
+	// nfgenmsg: family, version and the group as resource id
+	b[syscall.NLMSG_HDRLEN] = family
+	binary.BigEndian.PutUint16(b[syscall.NLMSG_HDRLEN+2:], uint16(group))
+	if err := syscall.Sendto(fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	// the packets logged meanwhile are skipped
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EINTR || err == syscall.ENOBUFS {
+				continue
+			}
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type == syscall.NLMSG_ERROR && len(m.Data) >= 4 {
+				if errno := int32(binary.LittleEndian.Uint32(m.Data)); errno != 0 {
+					return syscall.Errno(-errno)
+				}
+				return nil
+			}
+		}
+	}
+}
+
+// Parses the attributes of a NFLOG packet message
+func parseNFLog(attrs []byte) (Blocked, bool) {
+	b := Blocked{Time: time.Now(), UID: -1, GID: -1}
+	var payload []byte
+	for len(attrs) >= 4 {
+		l := int(binary.LittleEndian.Uint16(attrs))
+		typ := binary.LittleEndian.Uint16(attrs[2:]) & 0x3fff
+		if l < 4 || l > len(attrs) {
+			break
+		}
+		data := attrs[4:l]
+		switch typ {
+		case nfulaPrefix:
+			b.Prefix = strings.TrimRight(string(data), "\x00")
+		case nfulaUID:
+			if len(data) == 4 {
+				b.UID = int(binary.BigEndian.Uint32(data))
+			}
+		case nfulaGID:
+			if len(data) == 4 {
+				b.GID = int(binary.BigEndian.Uint32(data))
+			}
+		case nfulaPayload:
+			payload = data
+		}
+		l = (l + 3) &^ 3
+		if l > len(attrs) {
+			break
+		}
+		attrs = attrs[l:]
+	}
+	if !strings.HasPrefix(b.Prefix, "hidemego-") {
+		return b, false
+	}
+	return b, parseIPHeader(payload, &b)
+}
+
+// Fills the addresses, the protocol and the ports of b from an IPv4 or IPv6
+// packet
+func parseIPHeader(p []byte, b *Blocked) bool {
+	var proto byte
+	var l4 []byte
+	switch {
+	case len(p) >= 20 && p[0]>>4 == 4:
+		ihl := int(p[0]&0xf) * 4
+		if ihl < 20 || len(p) < ihl {
+			return false
+		}
+		proto = p[9]
+		b.Src, b.Dst = net.IP(p[12:16]).String(), net.IP(p[16:20]).String()
+		l4 = p[ihl:]
+	case len(p) >= 40 && p[0]>>4 == 6:
+		proto = p[6]
+		b.Src, b.Dst = net.IP(p[8:24]).String(), net.IP(p[24:40]).String()
+		l4 = p[40:]
+	default:
+		return false
+	}
+	switch proto {
+	case syscall.IPPROTO_TCP:
+		b.Proto = "TCP"
+	case syscall.IPPROTO_UDP:
+		b.Proto = "UDP"
+	case syscall.IPPROTO_ICMP:
+		b.Proto = "ICMP"
+	case syscall.IPPROTO_ICMPV6:
+		b.Proto = "ICMPv6"
+	default:
+		b.Proto = strconv.Itoa(int(proto))
+	}
+	if (b.Proto == "TCP" || b.Proto == "UDP") && len(l4) >= 4 {
+		b.SPort = int(binary.BigEndian.Uint16(l4))
+		b.DPort = int(binary.BigEndian.Uint16(l4[2:]))
+	}
+	return true
+}
+
+// Returns the pid and the command name of the process owning the local TCP
+// or UDP socket bound to port, the socket must still be open. A uid other
+// than -1 must own the socket.
+func SocketProcess(proto string, port, uid int) (int, string, error) {
+	inode, err := socketInode(strings.ToLower(proto), port, uid)
+	if err != nil {
+		return 0, "", err
+	}
+	target := "socket:[" + inode + "]"
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0, "", err
+	}
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		fds, err := ioutil.ReadDir(path.Join("/proc", p.Name(), "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if l, err := os.Readlink(path.Join("/proc", p.Name(), "fd", fd.Name())); err == nil && l == target {
+				comm, _ := ioutil.ReadFile(path.Join("/proc", p.Name(), "comm"))
+				return pid, strings.TrimSpace(string(comm)), nil
+			}
+		}
+	}
+	return 0, "", fmt.Errorf("no process owns the socket")
+}
+
+// Returns the inode of the socket bound to the local port in
+// /proc/net/{tcp,udp}[6]
+func socketInode(proto string, port, uid int) (string, error) {
+	if proto != "tcp" && proto != "udp" {
+		return "", fmt.Errorf("unsupported protocol %s", proto)
+	}
+	local := fmt.Sprintf(":%04X", port)
+	for _, f := range []string{proto, proto + "6"} {
+		b, err := ioutil.ReadFile(path.Join("/proc/net", f))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(b), "\n")[1:] {
+			// sl local_address rem_address st tx:rx tr:tm retrnsmt uid timeout inode
+			fields := strings.Fields(line)
+			if len(fields) > 9 && strings.HasSuffix(fields[1], local) && fields[9] != "0" &&
+				(uid < 0 || fields[7] == strconv.Itoa(uid)) {
+				return fields[9], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no socket bound to port %d", port)
+}
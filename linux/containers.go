@@ -0,0 +1,40 @@
+package linux
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/multiversecoder/hidemego/tools"
+)
+
+// Returns the bridge interface of a container network, name is either the
+// bridge itself or a docker or podman network name
+func ContainerBridge(name string) (string, error) {
+	if HasIface(name) {
+		return name, nil
+	}
+	if docker, _ := tools.Which("docker"); docker != "" {
+		out, err := exec.Command(docker, "network", "inspect", "--format",
+			`{{index .Options "com.docker.network.bridge.name"}} {{.Driver}} {{.Id}}`, name).Output()
+		if err == nil {
+			f := strings.Fields(string(out))
+			switch {
+			case len(f) == 3:
+				return f[0], nil
+			case len(f) == 2 && f[0] == "bridge" && len(f[1]) >= 12:
+				// user defined networks are named after their ID
+				return "br-" + f[1][:12], nil
+			case len(f) == 2:
+				return "", fmt.Errorf("the docker network %s uses the %s driver, not bridge", name, f[0])
+			}
+		}
+	}
+	if podman, _ := tools.Which("podman"); podman != "" {
+		out, err := exec.Command(podman, "network", "inspect", "--format", "{{.NetworkInterface}}", name).Output()
+		if iface := strings.TrimSpace(string(out)); err == nil && iface != "" {
+			return iface, nil
+		}
+	}
+	return "", fmt.Errorf("%s is neither an interface nor a docker or podman network", name)
+}
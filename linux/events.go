@@ -0,0 +1,104 @@
+package linux
+
+import (
+	"path"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// rtnetlink multicast groups, missing from syscall
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+)
+
+// Sends the name of what changed on events when resolv.conf is written or
+// replaced and when a network interface or its addresses change. Events are
+// dropped while the receiver is busy, so events should be buffered.
+func Events(events chan<- string) error {
+	in, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	// NetworkManager and resolvconf replace resolv.conf, watch its directory
+	if _, err := syscall.InotifyAddWatch(in, path.Dir(resolvConf),
+		syscall.IN_CLOSE_WRITE|syscall.IN_CREATE|syscall.IN_DELETE|syscall.IN_MOVED_TO|syscall.IN_MOVED_FROM); err != nil {
+		syscall.Close(in)
+		return err
+	}
+	nl, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		syscall.Close(in)
+		return err
+	}
+	if err := syscall.Bind(nl, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr}); err != nil {
+		syscall.Close(in)
+		syscall.Close(nl)
+		return err
+	}
+	go inotifyEvents(in, events)
+	go netlinkEvents(nl, events)
+	return nil
+}
+
+func notify(events chan<- string, name string) {
+	select {
+	case events <- name:
+	default:
+	}
+}
+
+func inotifyEvents(fd int, events chan<- string) {
+	defer syscall.Close(fd)
+	name := path.Base(resolvConf)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			e := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + syscall.SizeofInotifyEvent
+			off = start + int(e.Len)
+			if off > n {
+				break
+			}
+			if strings.TrimRight(string(buf[start:off]), "\x00") == name {
+				notify(events, name)
+			}
+		}
+	}
+}
+
+func netlinkEvents(fd int, events chan<- string) {
+	defer syscall.Close(fd)
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EINTR || err == syscall.ENOBUFS {
+				continue
+			}
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case syscall.RTM_NEWLINK, syscall.RTM_DELLINK:
+				notify(events, "link")
+			case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+				notify(events, "address")
+			}
+		}
+	}
+}
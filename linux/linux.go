@@ -4,20 +4,27 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/multiversecoder/hidemego/systemd"
 	"github.com/multiversecoder/hidemego/tools"
 )
 
 var (
-	previousSysctlConf = path.Join(os.Getenv("HOME"), ".config", "hidemego", "prev.sysctl.conf")
-	ipCommand, _       = tools.Which("ip")
-	ipTablesCommand, _ = tools.Which("iptables")
-	resolvConf         = path.Join("/", "etc", "resolv.conf")
+	previousSysctlConf  = path.Join(os.Getenv("HOME"), ".config", "hidemego", "prev.sysctl.conf")
+	previousForwarding  = path.Join(os.Getenv("HOME"), ".config", "hidemego", "prev.forwarding")
+	previousPolicies    = path.Join(os.Getenv("HOME"), ".config", "hidemego", "prev.policies")
+	ipCommand, _        = tools.Which("ip")
+	ipTablesCommand, _  = tools.Which("iptables")
+	ip6TablesCommand, _ = tools.Which("ip6tables")
+	resolvConf          = path.Join("/", "etc", "resolv.conf")
+	networkService      = "NetworkManager.service"
 )
 
 func DefaultMacAddr(iface string) (string, error) {
@@ -29,20 +36,10 @@ func DefaultMacAddr(iface string) (string, error) {
 }
 
 func RestartNetwork(reload ...bool) error {
-	var (
-		relo   bool
-		action string
-	)
-	if len(reload) > 0 {
-		relo = reload[0]
-	}
-	switch relo {
-	case true:
-		action = "reload"
-	case false:
-		action = "restart"
+	if len(reload) > 0 && reload[0] {
+		return systemd.System.Reload(networkService)
 	}
-	return exec.Command("systemctl", action, "NetworkManager.service").Run()
+	return systemd.System.Restart(networkService)
 }
 
 func DefaultIfaces() ([]string, error) {
@@ -57,6 +54,21 @@ func DefaultIfaces() ([]string, error) {
 	return strings.Split(strings.TrimSuffix(string(cmd), "\n"), "\n"), nil
 }
 
+// Lists the interfaces backed by a physical device
+func PhysicalIfaces() ([]string, error) {
+	ifaces, err := DefaultIfaces()
+	if err != nil {
+		return nil, err
+	}
+	var phys []string
+	for _, i := range ifaces {
+		if _, err := os.Stat(path.Join("/", "sys", "class", "net", i, "device")); err == nil {
+			phys = append(phys, i)
+		}
+	}
+	return phys, nil
+}
+
 func HasIface(iface string) bool {
 	ifaces, err := DefaultIfaces()
 	if err != nil {
@@ -104,6 +116,42 @@ func SELManage(port int, add bool, dns ...bool) error {
 	return nil
 }
 
+// Labels the executable at p so that tor can run it as a pluggable
+// transport, or removes the label
+func SELManageExec(p string, add bool) error {
+	args := []string{"fcontext", "-d", p}
+	if add {
+		args = []string{"fcontext", "-a", "-t", "tor_exec_t", p}
+	}
+	if err := exec.Command("semanage", args...).Run(); err != nil {
+		return err
+	}
+	return exec.Command("restorecon", p).Run()
+}
+
+// Checks if p is already labeled as a tor executable
+func IsSELTorExec(p string) bool {
+	cmd, err := exec.Command("stat", "-c", "%C", p).Output()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(cmd), ":tor_exec_t:")
+}
+
+// Checks if a local file context rule for p exists
+func HasSELExecContext(p string) bool {
+	cmd, err := exec.Command("semanage", "fcontext", "-l", "-C").Output()
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(cmd), "\n") {
+		if f := strings.Fields(line); len(f) > 0 && f[0] == p {
+			return true
+		}
+	}
+	return false
+}
+
 func HasSELPort(needle int) bool {
 	cmd, err := exec.Command("/bin/sh", "-c", fmt.Sprintf("semanage port -l | grep %d", needle)).Output()
 	if err != nil {
@@ -112,16 +160,137 @@ func HasSELPort(needle int) bool {
 	return strings.Contains(strings.TrimSuffix(string(cmd), "\n"), strconv.FormatInt(int64(needle), 10))
 }
 
-func SetIPTablesRules(nontor string, torid, port, dnsPort int) error {
+// Firewall contains the values used to render the iptables rules
+type Firewall struct {
+	ExcludedTorAddrs string
+	TorID            int
+	TorPort          int
+	DNSPort          int
+	// KillSwitch sets the default policies to DROP
+	KillSwitch bool
+	// ProxyIP and ProxyPort restrict the tor traffic to the upstream proxy
+	ProxyIP   string
+	ProxyPort int
+	// Bypass is the split tunnel traffic
+	Bypass Bypass
+	// Gateways are the interfaces whose clients are redirected to tor
+	Gateways []Gateway
+	// Isolated are the traffic classes redirected to their own TransPort
+	Isolated []Isolated
+	// UDPPolicy is drop, log or reject, the UDP traffic tor can't carry
+	// goes through it after UDPAllow
+	UDPPolicy   string
+	UDPLogGroup int
+	UDPAllow    []UDPDest
+	// LogDropped logs the packets dropped by the final rule: off, kernel
+	// (LOG) or nflog, at most LogRate per minute
+	LogDropped string
+	LogGroup   int
+	LogRate    int
+}
+
+// UDPDest is a UDP destination reached without tor
+type UDPDest struct {
+	Network string
+	Port    int
+}
+
+// Isolated selects the traffic redirected to a dedicated TransPort
+type Isolated struct {
+	Port      int
+	Users     []string
+	Groups    []string
+	DestPorts []int
+}
+
+// Returns the iptables matches of the class, every user and group is
+// combined with every destination port
+func (i Isolated) Matches() []string {
+	owners := Bypass{Users: i.Users, Groups: i.Groups}.Matches()
+	if len(i.DestPorts) == 0 {
+		return owners
+	}
+	if len(owners) == 0 {
+		owners = []string{""}
+	}
+	var m []string
+	for _, o := range owners {
+		for _, p := range i.DestPorts {
+			m = append(m, strings.TrimSpace(o+" --dport "+strconv.Itoa(p)))
+		}
+	}
+	return m
+}
+
+// Gateway is an interface whose clients are redirected to tor
+type Gateway struct {
+	Iface string
+	// Addr is the address of Iface where tor listens
+	Addr string
+	// Container marks the bridge of a container network, the chains of the
+	// container runtime keep handling the published ports and the traffic
+	// between the containers
+	Container bool
+}
+
+// Bypass selects the traffic that bypasses tor
+type Bypass struct {
+	Users   []string
+	Groups  []string
+	CGroups []string
+	// Networks are destinations that always bypass tor
+	Networks []string
+	// TorifyOnly routes through tor only the traffic of Users, Groups and
+	// CGroups, the rest bypasses it
+	TorifyOnly bool
+}
+
+// Returns the iptables matches of the users, groups and cgroups
+func (b Bypass) Matches() []string {
+	var m []string
+	for _, u := range b.Users {
+		m = append(m, "-m owner --uid-owner "+u)
+	}
+	for _, g := range b.Groups {
+		m = append(m, "-m owner --gid-owner "+g+" --suppl-groups")
+	}
+	for _, cg := range b.CGroups {
+		m = append(m, "-m cgroup --path "+strings.TrimPrefix(cg, "/"))
+	}
+	return m
+}
+
+func SetIPTablesRules(fw Firewall) error {
 	var tb bytes.Buffer
 	var m = make(map[string]interface{})
 	m["IPTables"] = ipTablesCommand
-	m["ExcludedTorAddrs"] = nontor
-	m["TorID"] = torid
-	m["TorPort"] = port
-	m["DNSPort"] = dnsPort
+	m["IP6Tables"] = ip6TablesCommand
+	m["ExcludedTorAddrs"] = fw.ExcludedTorAddrs
+	m["TorID"] = fw.TorID
+	m["TorPort"] = fw.TorPort
+	m["DNSPort"] = fw.DNSPort
+	m["KillSwitch"] = fw.KillSwitch
+	m["ProxyIP"] = fw.ProxyIP
+	m["ProxyPort"] = fw.ProxyPort
+	m["Bypass"] = fw.Bypass.Matches()
+	m["BypassNets"] = strings.Join(fw.Bypass.Networks, " ")
+	m["TorifyOnly"] = fw.Bypass.TorifyOnly
+	m["Gateways"] = fw.Gateways
+	m["Isolated"] = fw.Isolated
+	m["UDPPolicy"] = fw.UDPPolicy
+	m["UDPLogGroup"] = fw.UDPLogGroup
+	m["UDPAllow"] = fw.UDPAllow
+	m["UDPPrefix"] = UDPPrefix
+	m["LogDropped"] = fw.LogDropped
+	m["LogGroup"] = fw.LogGroup
+	m["LogRate"] = fw.LogRate
+	m["DropPrefix"] = DropPrefix
 	m["IfaceIF"] = "wlo1"
 	m["IfaceOF"] = "wlo1"
+	if err := savePolicies(); err != nil {
+		return err
+	}
+	m["Policies"] = policies()
 	tb, err := tools.Read("iptr", m)
 	if err != nil {
 		return err
@@ -146,6 +315,8 @@ func FlushIPTablesRules() error {
 	var tb bytes.Buffer
 	var m = make(map[string]interface{})
 	m["IPTables"] = ipTablesCommand
+	m["IP6Tables"] = ip6TablesCommand
+	m["Policies"] = policies()
 	tb, err := tools.Read("iptf", m)
 	if err != nil {
 		return err
@@ -163,6 +334,76 @@ func FlushIPTablesRules() error {
 	if err := flush.Run(); err != nil {
 		return err
 	}
+	if err := os.Remove(previousPolicies); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Saves the iptables and ip6tables default policies found before the
+// session, e.g. the FORWARD DROP of docker, so that they are restored
+// instead of being reset to ACCEPT
+func savePolicies() error {
+	if _, err := os.Stat(previousPolicies); !os.IsNotExist(err) {
+		return nil
+	}
+	var b strings.Builder
+	for _, cmd := range []string{ipTablesCommand, ip6TablesCommand} {
+		if cmd == "" {
+			continue
+		}
+		out, err := exec.Command(cmd, "-S").Output()
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "-P ") {
+				b.WriteString(cmd + " " + line + "\n")
+			}
+		}
+	}
+	return ioutil.WriteFile(previousPolicies, []byte(b.String()), 0644)
+}
+
+// Returns the commands restoring the policies saved by savePolicies, the
+// policies are ACCEPT when nothing was saved
+func policies() []string {
+	if b, err := ioutil.ReadFile(previousPolicies); err == nil {
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+	var cmds []string
+	for _, cmd := range []string{ipTablesCommand, ip6TablesCommand} {
+		if cmd == "" {
+			continue
+		}
+		for _, chain := range []string{"INPUT", "FORWARD", "OUTPUT"} {
+			cmds = append(cmds, cmd+" -P "+chain+" ACCEPT")
+		}
+	}
+	return cmds
+}
+
+// Blocks all the traffic but the loopback setting the iptables and
+// ip6tables default policies to DROP, FlushIPTablesRules restores them
+func KillSwitch() error {
+	for _, cmd := range []string{ipTablesCommand, ip6TablesCommand} {
+		if cmd == "" {
+			continue
+		}
+		for _, chain := range []string{"INPUT", "FORWARD", "OUTPUT"} {
+			if err := exec.Command(cmd, "-P", chain, "DROP").Run(); err != nil {
+				return err
+			}
+		}
+		// drop everything but loopback, even what the hidemego rules accept
+		for _, r := range [][]string{
+			{"-I", "OUTPUT", "1", "!", "-o", "lo", "-j", "DROP"},
+			{"-I", "INPUT", "1", "!", "-i", "lo", "-j", "DROP"}} {
+			if err := exec.Command(cmd, r...).Run(); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -214,21 +455,85 @@ func RestoreResolvConf() error {
 	return fmt.Errorf("%s.orig does not exists", resolvConf)
 }
 
-func PrepareLinuxKernel() {
-	// diable ipv6
-	tools.SetSysctl("net.ipv6.conf.lo.disable_ipv6=1")
-	tools.SetSysctl("net.ipv6.conf.all.disable_ipv6=1")
-	tools.SetSysctl("net.ipv6.conf.default.disable_ipv6=1")
+// HardenedSysctls are the kernel settings applied by PrepareLinuxKernel
+var HardenedSysctls = map[string]string{
+	// disable ipv6
+	"net.ipv6.conf.lo.disable_ipv6":      "1",
+	"net.ipv6.conf.all.disable_ipv6":     "1",
+	"net.ipv6.conf.default.disable_ipv6": "1",
 	// disable kernel ip forwarding
-	tools.SetSysctl("net.ipv4.ip_forward=0")
+	"net.ipv4.ip_forward": "0",
 	// ignome icmp echo packets
-	tools.SetSysctl("net.ipv4.icmp_echo_ignore_all=1")
+	"net.ipv4.icmp_echo_ignore_all": "1",
 	//tcp_mut_probing
-	tools.SetSysctl("net.ipv4.tcp_mtu_probing=1")
+	"net.ipv4.tcp_mtu_probing": "1",
 	// prevent timestamp packet leakage
-	tools.SetSysctl("net.ipv4.tcp_timestamps=0")
+	"net.ipv4.tcp_timestamps": "0",
 	// prevent assasination
-	tools.SetSysctl("net.ipv4.tcp_rfc1337=1")
+	"net.ipv4.tcp_rfc1337": "1",
+}
+
+func PrepareLinuxKernel() {
+	for k, v := range HardenedSysctls {
+		tools.SetSysctl(k + "=" + v)
+	}
+}
+
+// Returns the forwarding sysctl of iface. The key is separated by slashes,
+// a VLAN iface like eth0.100 has a dot in its name.
+func ForwardingSysctl(iface string) string {
+	return path.Join("net", "ipv4", "conf", iface, "forwarding")
+}
+
+// Enables the forwarding of the packets received on iface, the global
+// net.ipv4.ip_forward is left untouched. The previous value is saved for
+// RestoreForwarding.
+func EnableForwarding(iface string) error {
+	key := ForwardingSysctl(iface)
+	if _, err := os.Stat(previousForwarding); os.IsNotExist(err) {
+		v, err := SysctlValue(key)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(previousForwarding, []byte(key+"="+v+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return tools.SetSysctl(key + "=1")
+}
+
+// Restores the forwarding of the gateway interface changed by
+// EnableForwarding
+func RestoreForwarding() error {
+	b, err := ioutil.ReadFile(previousForwarding)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := tools.SetSysctl(strings.TrimSpace(string(b))); err != nil {
+		return err
+	}
+	return os.Remove(previousForwarding)
+}
+
+// Returns the first IPv4 address of iface
+func IfaceIPv4(iface string) (string, error) {
+	i, err := net.InterfaceByName(iface)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := i.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			return n.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no IPv4 address", iface)
 }
 
 func SaveKernelConfigs() error {
@@ -268,3 +573,19 @@ func RestoreKernelConfig() error {
 	}
 	return nil
 }
+
+// Steps the system clock by offset and saves it to the hardware clock, when
+// there is one, so that the next boot starts close to the right time
+func StepClock(offset time.Duration) error {
+	t := time.Now().Add(offset)
+	at := fmt.Sprintf("@%d.%03d", t.Unix(), t.Nanosecond()/int(time.Millisecond))
+	if out, err := exec.Command("date", "-u", "-s", at).CombinedOutput(); err != nil {
+		return fmt.Errorf("date: %v: %s", err, bytes.TrimSpace(out))
+	}
+	if hwclock, _ := tools.Which("hwclock"); hwclock != "" {
+		if _, err := os.Stat("/dev/rtc"); err == nil {
+			exec.Command(hwclock, "--systohc").Run()
+		}
+	}
+	return nil
+}
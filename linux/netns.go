@@ -0,0 +1,104 @@
+package linux
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/multiversecoder/hidemego/tools"
+)
+
+// ExecChain is the iptables chain redirecting the namespace traffic, it is
+// created in the nat and in the filter tables
+const ExecChain = "HIDEMEGO-EXEC"
+
+// Netns is a network namespace connected to the host by a veth pair, its
+// TCP and DNS traffic is redirected to the host end of the pair
+type Netns struct {
+	Name      string
+	HostIface string
+	NsIface   string
+	// HostIP and NsIP are the addresses of the /30 veth network
+	HostIP string
+	NsIP   string
+}
+
+// ExecNetns is the namespace of hidemego exec
+var ExecNetns = Netns{
+	Name:      "hidemego",
+	HostIface: "hmexec0",
+	NsIface:   "hmexec1",
+	HostIP:    "10.152.152.1",
+	NsIP:      "10.152.152.2"}
+
+func (n Netns) values() map[string]interface{} {
+	return map[string]interface{}{
+		"Ip":        ipCommand,
+		"IPTables":  ipTablesCommand,
+		"IP6Tables": ip6TablesCommand,
+		"Name":      n.Name,
+		"HostIface": n.HostIface,
+		"NsIface":   n.NsIface,
+		"HostIP":    n.HostIP,
+		"NsIP":      n.NsIP,
+		"Chain":     ExecChain,
+		// ip netns exec bind mounts it over /etc/resolv.conf
+		"ResolvDir": path.Join("/", "etc", "netns", n.Name)}
+}
+
+// Reports whether the namespace exists
+func (n Netns) Exists() bool {
+	_, err := os.Stat(path.Join("/", "run", "netns", n.Name))
+	return err == nil
+}
+
+// Lists the processes running in the namespace
+func (n Netns) PIDs() ([]string, error) {
+	out, err := exec.Command(ipCommand, "netns", "pids", n.Name).Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// Creates the namespace and the veth pair, the namespace traffic is
+// redirected to transPort and dnsPort on HostIP and everything else is
+// dropped
+func (n Netns) Create(transPort, dnsPort int) error {
+	m := n.values()
+	m["TransPort"] = transPort
+	m["DNSPort"] = dnsPort
+	return runScript("netns", "hidemego_netns", m)
+}
+
+// Removes the namespace, the veth pair and the host rules, what is already
+// gone is skipped
+func (n Netns) Remove() error {
+	return runScript("netnsf", "hidemego_netns_flush", n.values())
+}
+
+// Returns the command running name with args inside the namespace
+func (n Netns) Command(name string, args ...string) *exec.Cmd {
+	return exec.Command(ipCommand, append([]string{"netns", "exec", n.Name, name}, args...)...)
+}
+
+func runScript(name, prefix string, m map[string]interface{}) error {
+	tb, err := tools.Read(name, m)
+	if err != nil {
+		return err
+	}
+	script, err := tools.TempFile(prefix, tb.Bytes())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(script)
+	if out, err := exec.Command("/bin/bash", script).CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package linux
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/multiversecoder/hidemego/tools"
+)
+
+var (
+	ipTablesSaveCommand, _  = tools.Which("iptables-save")
+	ip6TablesSaveCommand, _ = tools.Which("ip6tables-save")
+	// packet and byte counters of the iptables-save chain lines
+	countersRgx = regexp.MustCompile(`\s*\[\d+:\d+\]$`)
+	// hookedChains are the builtin chains jumping to the HIDEMEGO-* chains
+	hookedChains = map[string]bool{
+		"filter INPUT":   true,
+		"filter OUTPUT":  true,
+		"filter FORWARD": true,
+		"nat OUTPUT":     true,
+		"nat PREROUTING": true}
+)
+
+// State is the system state applied by a hidemego session, it is compared
+// with the live state to detect what other programs changed
+type State struct {
+	// Firewall are the iptables and ip6tables rules, one per line prefixed
+	// by the table
+	Firewall   []string `json:"firewall"`
+	ResolvConf string   `json:"resolv_conf"`
+	// MACs maps the interfaces to their assigned MAC addresses
+	MACs map[string]string `json:"macs,omitempty"`
+	// Sysctls maps the kernel settings to their applied values
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+}
+
+// Drift is a difference between the session state and the live state
+type Drift struct {
+	// Kind is firewall, resolv.conf, mac or sysctl
+	Kind string
+	// Name is the interface or the kernel setting
+	Name      string
+	Want, Got string
+	// Diff are the firewall rules added (+) or removed (-)
+	Diff []string
+}
+
+func (d Drift) String() string {
+	if d.Name == "" {
+		return d.Kind
+	}
+	return d.Kind + " " + d.Name
+}
+
+// Records the live state, the MAC addresses of ifaces and the values of
+// sysctls
+func Snapshot(ifaces, sysctls []string) (State, error) {
+	var s State
+	var err error
+	if s.Firewall, err = FirewallRules(); err != nil {
+		return s, err
+	}
+	b, err := ioutil.ReadFile(resolvConf)
+	if err != nil {
+		return s, err
+	}
+	s.ResolvConf = string(b)
+	if len(ifaces) > 0 {
+		s.MACs = map[string]string{}
+	}
+	for _, i := range ifaces {
+		if s.MACs[i], err = MACAddr(i); err != nil {
+			return s, err
+		}
+	}
+	if len(sysctls) > 0 {
+		s.Sysctls = map[string]string{}
+	}
+	for _, k := range sysctls {
+		if s.Sysctls[k], err = SysctlValue(k); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// Compares the state with the live state, drift is sorted by kind and name
+func (s State) Compare() ([]Drift, error) {
+	var drift []Drift
+	ifaces := make([]string, 0, len(s.MACs))
+	for i := range s.MACs {
+		ifaces = append(ifaces, i)
+	}
+	sysctls := make([]string, 0, len(s.Sysctls))
+	for k := range s.Sysctls {
+		sysctls = append(sysctls, k)
+	}
+	sort.Strings(ifaces)
+	sort.Strings(sysctls)
+	live, err := Snapshot(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if diff := diffRules(s.Firewall, live.Firewall); diff != nil {
+		drift = append(drift, Drift{Kind: "firewall", Diff: diff})
+	}
+	if live.ResolvConf != s.ResolvConf {
+		drift = append(drift, Drift{Kind: "resolv.conf", Want: s.ResolvConf, Got: live.ResolvConf})
+	}
+	for _, i := range ifaces {
+		// a missing interface can't leak its MAC address
+		mac, err := MACAddr(i)
+		if err == nil && !strings.EqualFold(mac, s.MACs[i]) {
+			drift = append(drift, Drift{Kind: "mac", Name: i, Want: s.MACs[i], Got: mac})
+		}
+	}
+	for _, k := range sysctls {
+		v, err := SysctlValue(k)
+		if err != nil {
+			return nil, err
+		}
+		if v != s.Sysctls[k] {
+			drift = append(drift, Drift{Kind: "sysctl", Name: k, Want: s.Sysctls[k], Got: v})
+		}
+	}
+	return drift, nil
+}
+
+// Returns the rules removed from want (-) and added to got (+), the rules
+// moved when both are empty, nil when the rulesets are the same
+func diffRules(want, got []string) []string {
+	if strings.Join(want, "\n") == strings.Join(got, "\n") {
+		return nil
+	}
+	count := map[string]int{}
+	for _, r := range got {
+		count[r]++
+	}
+	var diff []string
+	for _, r := range want {
+		if count[r] > 0 {
+			count[r]--
+			continue
+		}
+		diff = append(diff, "-"+r)
+	}
+	for _, r := range got {
+		if count[r] > 0 {
+			count[r]--
+			diff = append(diff, "+"+r)
+		}
+	}
+	if diff == nil {
+		diff = []string{"rules reordered"}
+	}
+	return diff
+}
+
+// Dumps the iptables and ip6tables rules of hidemego without comments and
+// counters, every rule is prefixed by its table, e.g. "ip4 nat -A OUTPUT
+// ...". The chains of other programs such as docker are skipped, of the
+// builtin chains hooked by hidemego only the policy and the rules up to the
+// hidemego jump are kept.
+func FirewallRules() ([]string, error) {
+	var rules []string
+	for _, t := range []struct{ family, cmd string }{
+		{"ip4", ipTablesSaveCommand},
+		{"ip6", ip6TablesSaveCommand}} {
+		if t.cmd == "" {
+			continue
+		}
+		out, err := exec.Command(t.cmd).Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path.Base(t.cmd), err)
+		}
+		var table string
+		// hooked are the builtin chains whose hidemego jump was seen
+		hooked := map[string]bool{}
+		for _, line := range strings.Split(string(out), "\n") {
+			line = strings.TrimSpace(line)
+			var chain string
+			if f := strings.Fields(line); len(f) > 1 && f[0] == "-A" {
+				chain = f[1]
+			} else if strings.HasPrefix(line, ":") && len(f) > 0 {
+				chain = f[0][1:]
+			}
+			switch {
+			case line == "" || strings.HasPrefix(line, "#") || line == "COMMIT":
+			case strings.HasPrefix(line, "*"):
+				table = line[1:]
+				hooked = map[string]bool{}
+			case strings.Contains(line, ExecChain) || strings.Contains(line, ExecNetns.HostIface):
+				// hidemego exec rules come and go with the command
+			case strings.HasPrefix(chain, "HIDEMEGO-"):
+				rules = append(rules, t.family+" "+table+" "+countersRgx.ReplaceAllString(line, ""))
+			case hookedChains[table+" "+chain] && !hooked[chain]:
+				if strings.HasSuffix(line, "-j HIDEMEGO-"+chain) {
+					hooked[chain] = true
+				}
+				rules = append(rules, t.family+" "+table+" "+countersRgx.ReplaceAllString(line, ""))
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Returns the live MAC address of iface
+func MACAddr(iface string) (string, error) {
+	i, err := net.InterfaceByName(iface)
+	if err != nil {
+		return "", err
+	}
+	return i.HardwareAddr.String(), nil
+}
+
+// Returns the live value of a kernel setting, e.g. net.ipv4.ip_forward.
+// Like sysctl, a key with a slash is the path under /proc/sys.
+func SysctlValue(key string) (string, error) {
+	if !strings.Contains(key, "/") {
+		key = strings.ReplaceAll(key, ".", "/")
+	}
+	b, err := ioutil.ReadFile(path.Join("/", "proc", "sys", key))
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(strings.Fields(string(b)), " "), nil
+}
+
+// Counter is the packet and byte count of a firewall rule
+type Counter struct {
+	// Name is the comment of the rule
+	Name    string `json:"name"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// counterRgx matches the commented rules of iptables-save -c
+var counterRgx = regexp.MustCompile(`^\[(\d+):(\d+)\] -A (\S+) .*--comment (?:"([^"]*)"|(\S+))`)
+
+// Returns the counters of the rules of the UDP policy, allowed
+// destinations first
+func UDPCounters() ([]Counter, error) {
+	out, err := exec.Command(ipTablesSaveCommand, "-c", "-t", "filter").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path.Base(ipTablesSaveCommand), err)
+	}
+	var counters []Counter
+	for _, line := range strings.Split(string(out), "\n") {
+		m := counterRgx.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil || m[3] != "HIDEMEGO-UDP" {
+			continue
+		}
+		c := Counter{Name: m[4] + m[5]}
+		c.Packets, _ = strconv.ParseUint(m[1], 10, 64)
+		c.Bytes, _ = strconv.ParseUint(m[2], 10, 64)
+		counters = append(counters, c)
+	}
+	return counters, nil
+}
@@ -1,391 +1,219 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
-	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/signal"
 	"path"
 	"strings"
 	"sync"
-	"time"
 
+	"github.com/multiversecoder/hidemego/config"
 	"github.com/multiversecoder/hidemego/linux"
-	"github.com/multiversecoder/hidemego/tools"
-	"github.com/multiversecoder/hidemego/tor"
 )
 
 var (
-	logger                = log.New(os.Stdout, "hidemego ", log.Ldate|log.Ltime)
-	fl                    = flag.NewFlagSet("hidemego", flag.ExitOnError)
-	torPass               string
-	torUser               string
-	torID                 int
-	torPort               int
-	socksDestPort         int
-	socksAuthPort         int
-	controlPort           int
-	dnsPort               int
-	no5, no9, no14, no14p bool
-	ifaces                string
-	once                  = sync.Once{}
-	nokch                 bool
-	confDir               = path.Join(os.Getenv("HOME"), ".config", "hidemego")
+	logger      = log.New(os.Stdout, "hidemego ", log.Ldate|log.Ltime)
+	once        = sync.Once{}
+	confDir     = path.Join(os.Getenv("HOME"), ".config", "hidemego")
+	sessionFile = path.Join(confDir, "session.toml")
+	// system state applied by the session, see linux.State
+	stateFile = path.Join(confDir, "state.json")
+	// configuration keys overridden by the session flags
+	flagKeys = map[string]string{
+		"pass":   "tor.control_password",
+		"user":   "tor.user",
+		"id":     "tor.id",
+		"tport":  "tor.trans_port",
+		"sdport": "tor.socks_dest_port",
+		"saport": "tor.socks_auth_port",
+		"cport":  "tor.control_port",
+		"dport":  "tor.dns_port",
+		"ifaces": "network.ifaces",
+		// daemon drift detection
+		"watch":    "watch.interval",
+		"on-drift": "watch.on_drift",
+		// country lists
+		"exclude-countries":      "nodes.exclude",
+		"exclude-exit-countries": "nodes.exclude_exit",
+		"entry-countries":        "nodes.entry",
+		"exit-countries":         "nodes.exit",
+		// upstream proxy
+		"upstream-proxy":             "upstream_proxy.url",
+		"upstream-proxy-credentials": "upstream_proxy.credentials_file",
+		"gateway-iface":              "gateway.iface",
+		"container-networks":         "containers.networks",
+		// local proxies of the daemon
+		"http-proxy":        "local_proxy.http",
+		"socks-proxy":       "local_proxy.socks",
+		"proxy-credentials": "local_proxy.credentials_file",
+		// split tunnel
+		"split-mode":      "split_tunnel.mode",
+		"split-users":     "split_tunnel.users",
+		"split-groups":    "split_tunnel.groups",
+		"split-cgroups":   "split_tunnel.cgroups",
+		"bypass-networks": "split_tunnel.networks",
+		"log-dropped":     "firewall.log_dropped",
+		// udp policy
+		"udp-policy": "udp.policy",
+		"udp-allow":  "udp.allow",
+		// time synchronization
+		"time-sync":    "time_sync.enabled",
+		"time-sources": "time_sync.sources",
+		"max-step":     "time_sync.max_step",
+		// identity rotation
+		"every":        "identity.rotate_every",
+		"attempts":     "identity.attempts",
+		"exclude-last": "identity.exclude_last"}
+	// node exclusion flags and the related country group
+	eyesFlags = map[string]string{
+		"no5":   "@5eyes",
+		"no9":   "@9eyes",
+		"no14":  "@14eyes",
+		"no14p": "@14eyes+"}
 )
 
-func init() {
-
+// Registers the flags accepted by start
+func sessionFlags(fs *flag.FlagSet) {
+	d := config.Default()
+	torFlags(fs)
+	fs.String("pass", "", "The Tor Control Authentication Password")
+	fs.Int("sdport", d.Tor.SocksDestPort, "Socks Destination Port for 127.0.0.1.1")
+	fs.Int("saport", d.Tor.SocksAuthPort, "Socks Authentication Port for 127.0.0.1.0")
+	fs.Int("cport", d.Tor.ControlPort, "Tor Control Port for 127.0.0.1")
+	fs.Int("id", 0, "Tor user id. If no value is passed Hidemego will parse default-torrc to identify user and related id")
+	fs.String("ifaces", "", "Interfaces that must change MAC Address (separed by comma if multiple interfaces)")
+	fs.Bool("nkc", false, "Don't Change Kernel Configuration using Sysctl")
+	fs.String("gateway-iface", "", "Internal interface whose clients are routed through Tor (gateway mode)")
+	fs.String("container-networks", "", "Docker or podman networks whose containers are routed through Tor, comma separated network or bridge names")
+	fs.String("split-mode", d.SplitTunnel.Mode, "bypass: the split users, groups and cgroups bypass Tor, torify: only they go through Tor")
+	fs.String("split-users", "", "Users of the split tunnel, comma separated names or uids")
+	fs.String("split-groups", "", "Groups of the split tunnel, comma separated names or gids")
+	fs.String("split-cgroups", "", "Cgroups of the split tunnel, comma separated cgroup v2 paths (e.g. system.slice/backup.service)")
+	fs.String("bypass-networks", "", "Destinations that bypass Tor, comma separated IPv4 addresses or CIDRs")
+	fs.String("log-dropped", d.Firewall.LogDropped, "Log the packets dropped by the firewall: off, kernel or nflog, read them with 'hidemego audit'")
+	fs.String("udp-policy", d.UDP.Policy, "drop, log (NFLOG and drop) or reject (ICMP port unreachable) the UDP traffic Tor can't carry")
+	fs.String("udp-allow", "", "UDP destinations reached without Tor, comma separated address:port or CIDR:port (e.g. 192.168.1.1:123)")
+	fs.Bool("time-sync", false, "Set the clock from the Date header of web servers read through Tor, see 'hidemego timesync'")
 }
 
-func initialize() {
-	if _, err := os.Stat(confDir); os.IsNotExist(err) {
-		logger.Println("Creating Hidemego Config Directory")
-		os.MkdirAll(confDir, 0755)
-	}
-	if ok, _ := tools.Exists("tor"); !ok {
-		logger.Fatal(fmt.Errorf("fatal error: Tor is not installed"))
-	}
-	if ok, _ := tools.Exists("NetworkManager"); !ok {
-		logger.Fatal("fatal error: NetworkManager is not installed")
-	}
-	if _, err := os.Stat("/run/tor"); os.IsNotExist(err) {
-		os.Mkdir("/run/tor", 0700)
-	}
-	if _, err := os.Stat("/var/lib/tor/hidemego"); os.IsNotExist(err) {
-		os.Mkdir("/var/lib/tor/hidemego", 0700)
-	}
-	if ok, _ := tools.Exists("setenforce"); ok {
-		if err := tor.ChangeDirOwner("/run/tor"); err != nil {
-			logger.Fatal("Can't Change Dir Owner on /run/tor", err)
-		}
-		if err := tor.ChangeDirOwner("/var/lib/tor"); err != nil {
-			logger.Fatal("Can't Change Dir Owner on /var/lib/tor", err)
-		}
-		if err := tor.ChangeDirOwner("/var/run/tor"); err != nil {
-			logger.Fatal("Can't Change Dir Owner on /var/run/tor", err)
-		}
-		if err := tor.ChangeDirOwner("/var/lib/tor/hidemego"); err != nil {
-			logger.Fatal("Can't Change Dir Owner on /var/lib/tor/hidemego", err)
-		}
-		if !linux.HasSELPort(socksDestPort) {
-			logger.Println(fmt.Sprintf("Opening TCP Sock Dest Port on %d", socksDestPort))
-			if err := linux.SELManage(socksDestPort, true); err != nil {
-				logger.Fatal(err)
-			} // socks dest
-		}
-		if !linux.HasSELPort(socksAuthPort) {
-			logger.Println(fmt.Sprintf("Opening TCP Sock Auth Port on %d", socksAuthPort))
-			if err := linux.SELManage(socksAuthPort, true); err != nil {
-				logger.Fatal(err)
-			} // socks auth
-		}
-		if !linux.HasSELPort(controlPort) {
-			logger.Println(fmt.Sprintf("Opening TCP Control Port on %d", controlPort))
-			if err := linux.SELManage(controlPort, true); err != nil {
-				logger.Fatal(err)
-			} // control
-		}
-		if !linux.HasSELPort(torPort) {
-			logger.Println(fmt.Sprintf("Opening TCP Port on %d", torPort))
-			if err := linux.SELManage(torPort, true); err != nil {
-				logger.Fatal(err)
-			} // transport 
-		}
-		if !linux.HasSELPort(dnsPort) {
-			logger.Println(fmt.Sprintf("Opening TCP and UDP DNS Ports on %d", dnsPort))
-			if err := linux.SELManage(dnsPort, true, true); err != nil {
-				logger.Fatal(err)
-			} // dns
-		}
-	}
-	if !nokch {
-		logger.Println("Saving Kernel Configuration")
-		if err := linux.SaveKernelConfigs(); err != nil {
-			logger.Println("Can't Save Kernel Configuration. Restart The System after `stop`")
-			os.RemoveAll(confDir)
-			logger.Println(err)
-		}
-		logger.Println("Securing Kernel")
-		linux.PrepareLinuxKernel()
-
-	}
+// Registers the flags of the tor settings: configuration, ports, node
+// selection, bridges and upstream proxy
+func torFlags(fs *flag.FlagSet) {
+	d := config.Default()
+	fs.String("config", config.DefaultPath, "Configuration file")
+	fs.String("profile", "", "Configuration profile to apply, built-in profiles are "+strings.Join(config.Builtins(), ", "))
+	fs.String("user", "", "Tor process user name. If no value is passed. Hidemego will parse defaults-torrc to identify user")
+	fs.Int("tport", d.Tor.TransPort, "Tor Port")
+	fs.Int("dport", d.Tor.DNSPort, "DNS Port")
+	fs.Bool("no5", false, "Excludes Nodes from 5 eyes countries")
+	fs.Bool("no9", false, "Excludes Nodes from 9 eyes countries")
+	fs.Bool("no14", false, "Excludes Nodes from 14 eyes countries")
+	fs.Bool("no14p", false, "Excludes Nodes from 14 eyes countries plus other dangerous countries")
+	fs.String("exclude-countries", "", "Countries never used in a circuit, comma separated ISO codes or @groups (e.g. us,gb,@14eyes)")
+	fs.String("exclude-exit-countries", "", "Countries never used as exit, comma separated ISO codes or @groups")
+	fs.String("entry-countries", "", "The only countries used as guard, comma separated ISO codes or @groups")
+	fs.String("exit-countries", "", "The only countries used as exit, comma separated ISO codes or @groups (e.g. ch,is)")
+	fs.String("upstream-proxy", "", "Proxy tor connects through: http://host:port, socks4://host:port or socks5://host:port")
+	fs.String("upstream-proxy-credentials", "", "File with the user:password line of the upstream proxy")
+	fs.String("bridges", "", "File with one bridge line per line, or bridge lines separated by ';'. Enables the bridges")
 }
 
-func close() {
-	args, err := tools.PreviousArgs()
+// Loads the configuration file selected by the -config and -profile flags
+// and overrides it with the flags explicitly set on fs
+func sessionConfig(fs *flag.FlagSet) (config.Config, error) {
+	f, err := config.OpenOrDefault(fs.Lookup("config").Value.String())
 	if err != nil {
-		logger.Fatal("Can't get Parsed Flags")
+		return config.Config{}, err
 	}
-	if len(args) > 0 {
-		fl.Parse(args)
-	}
-
-	logger.Println("Stopping Tor Service")
-	if err := tor.Stop(); err != nil {
-		logger.Fatal("Can't Stop Tor:", err)
+	cfg, err := f.Config(fs.Lookup("profile").Value.String())
+	if err != nil {
+		return cfg, err
 	}
-	logger.Println("Restoring resolv.conf")
-	_ = linux.RestoreResolvConf()
-
-	if ifaces != "" {
-		var ifa []string = []string{}
-		tifa := strings.Split(ifaces, ",")
-		for _, t := range tifa {
-			if t != "" {
-				ifa = append(ifa, t)
-			}
-		}
-		for _, r := range ifa {
-			logger.Println("Changing MAC Address for", ifaces)
-
-			if !linux.HasIface(r) {
-				logger.Println(fmt.Sprintf("Invalid Network Interface %s Found! Skipping", r))
-				continue
-			}
-
-			if err := linux.IPSet(r, "down"); err != nil {
-				logger.Fatal(err)
-			}
-			dmac, err := linux.DefaultMacAddr(r)
-			if err != nil {
-				logger.Fatal(fmt.Sprintf("Can't Restore Default MAC Address for %s", r))
-			}
-			logger.Println(fmt.Sprintf("Restoring %s MAC Address: %s", r, dmac))
-			if err := linux.IPSetMACAddr(r, dmac); err != nil {
-				logger.Fatal(err)
+	fs.Visit(func(fl *flag.Flag) {
+		if err != nil {
+			return
+		}
+		if key, ok := flagKeys[fl.Name]; ok {
+			err = cfg.Set(key, fl.Value.String())
+			return
+		}
+		set := fl.Value.String() == "true"
+		if group, ok := eyesFlags[fl.Name]; ok && set {
+			cfg.Nodes.Exclude = append(cfg.Nodes.Exclude, group)
+		}
+		switch fl.Name {
+		case "nkc":
+			cfg.Kernel.Harden = !set
+		case "bridges":
+			cfg.Tor.UseBridges = true
+			if fi, serr := os.Stat(fl.Value.String()); serr == nil && !fi.IsDir() {
+				cfg.Tor.BridgesFile = fl.Value.String()
+				cfg.Tor.Bridges = nil
+				return
 			}
-			if err := linux.IPSet(r, "up"); err != nil {
-				logger.Fatal(err)
+			cfg.Tor.BridgesFile = ""
+			cfg.Tor.Bridges = nil
+			for _, line := range strings.Split(fl.Value.String(), ";") {
+				if line = strings.TrimSpace(line); line != "" {
+					cfg.Tor.Bridges = append(cfg.Tor.Bridges, line)
+				}
 			}
-			time.Sleep(3 * time.Second)
 		}
+	})
+	if err != nil {
+		return cfg, err
 	}
+	return cfg, cfg.Validate()
+}
 
-	logger.Println("Removing Hidemego TorRC File")
-	if err := tor.RemoveTorRc(); err != nil {
-		logger.Fatal("Can't Remove hidemego.torrc", err)
-	}
-	logger.Println("Removing Hidemego Directory")
-	if err := tor.RemoveHideMeGoDir(); err != nil {
-		logger.Fatal("Can't Remove Hidemego Dir:", err)
-	}
-	if linux.HasSELPort(socksDestPort) && socksDestPort != 9051 {
-		logger.Println(fmt.Sprintf("Closing TCP Port on %d", socksDestPort))
-		if err := linux.SELManage(socksDestPort, false); err != nil {
-			logger.Fatal(fmt.Sprintf("Can't Close Port: %d ", socksDestPort), err)
-		} // socks dest
-	}
-	if linux.HasSELPort(socksAuthPort) {
-		logger.Println(fmt.Sprintf("Closing TCP Port on %d", socksAuthPort))
-		if err := linux.SELManage(socksAuthPort, false); err != nil {
-			logger.Fatal(fmt.Sprintf("Can't Close Port: %d ", socksAuthPort), err)
-		} // socks auth
-	}
-	if linux.HasSELPort(controlPort) {
-		logger.Println(fmt.Sprintf("Closing TCP Port on %d", controlPort))
-		if err := linux.SELManage(controlPort, false); err != nil {
-			logger.Fatal(fmt.Sprintf("Can't Close Port: %d ", controlPort), err)
-		} // control
-	}
-	if linux.HasSELPort(torPort) {
-		logger.Println(fmt.Sprintf("Closing TCP Port on %d", torPort))
-		if err := linux.SELManage(torPort, false); err != nil {
-			logger.Fatal(fmt.Sprintf("Can't Close Port: %d ", torPort), err)
-		} // transport
-	}
-	if linux.HasSELPort(dnsPort) {
-		logger.Println(fmt.Sprintf("Closing TCP and UDP Ports on %d", dnsPort))
-		_ = linux.SELManage(dnsPort, false, true)
-	}
-
-	logger.Println("Flushing IPTables Rules")
-	if err := linux.FlushIPTablesRules(); err != nil {
-		logger.Fatal("Can't Flush IPTables Rules:", err)
-	}
-	if !nokch {
-		logger.Println("Restoring Kernel Configuration...")
-		if err := linux.RestoreKernelConfig(); err != nil {
-			logger.Println("Can't Restore Kernel Configuration:", err)
-			logger.Fatal("Restart Your System to Revert Some Changes")
+// Saves the configuration of the running session
+func saveSession(cfg config.Config) error {
+	if _, err := os.Stat(confDir); os.IsNotExist(err) {
+		logger.Println("Creating Hidemego Config Directory")
+		if err := os.MkdirAll(confDir, 0755); err != nil {
+			return err
 		}
 	}
+	return cfg.Write(sessionFile)
+}
 
-	logger.Println("Restarting the network using NetworkManager")
-	if err := linux.RestartNetwork(true); err != nil {
-		logger.Fatal("Can't Restart the Network:", err)
+func saveState(st linux.State) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
 	}
-	time.Sleep(3 * time.Second)
-	if tools.CheckConn() {
-		ip, err := tools.GetIPAddress()
+	return ioutil.WriteFile(stateFile, append(b, '\n'), 0600)
+}
+
+// Loads the configuration of the running session, falling back to the
+// configuration file when no session was saved
+func loadSession() (config.Config, error) {
+	if _, err := os.Stat(sessionFile); os.IsNotExist(err) {
+		f, err := config.OpenOrDefault(config.DefaultPath)
 		if err != nil {
-			logger.Fatal("Can't Get IP Address:", err)
+			return config.Config{}, err
 		}
-		logger.Println("Your new IP is", ip)
+		return f.Config("")
 	}
-	logger.Println("Removing Hidemego Config Directory")
-	os.RemoveAll(confDir)
+	return config.Read(sessionFile)
 }
 
-func main() {
-
-	fl.StringVar(&torPass, "pass", "", "The Tor Control Authentication Password")
-	fl.StringVar(&torUser, "user", "", "Tor process user name. If no value is passed. Hidemego will parse defaults-torrc to identify user")
-	fl.IntVar(&torPort, "tport", 9040, "Tor Port")
-	fl.IntVar(&socksDestPort, "sdport", 9051, "Socks Destination Port for 127.0.0.1.1")
-	fl.IntVar(&socksAuthPort, "saport", 9151, "Socks Authentication Port for 127.0.0.1.0")
-	fl.IntVar(&controlPort, "cport", 9052, "Tor Control Port for 127.0.0.1")
-	fl.IntVar(&dnsPort, "dport", 5354, "DNS Port")
-	fl.IntVar(&torID, "id", 0, "Tor user id. If no value is passed Hidemego will parse default-torrc to identify user and related id")
-	fl.StringVar(&ifaces, "ifaces", "", "Interfaces that must change MAC Address (separed by comma if multiple interfaces)")
-	fl.BoolVar(&no5, "no5", false, "Excludes Nodes from 5 eyes countries")
-	fl.BoolVar(&no9, "no9", false, "Excludes Nodes from 9 eyes countries")
-	fl.BoolVar(&no14, "no14", false, "Excludes Nodes from 14 eyes countries")
-	fl.BoolVar(&no14p, "no14p", false, "Excludes Nodes from 14 eyes countries plus other dangerous countries")
-	fl.BoolVar(&nokch, "nkc", false, "Don't Change Kernel Configuration using Sysctl")
-
-	if len(os.Args) < 2 {
-		fl.Usage()
-		return
-	}
-	args := os.Args[1:]
-
-	command := args[0]
-
-	sigs := make(chan os.Signal, 2)
-
-	if !tools.IsRoot() {
-		logger.Fatal(fmt.Errorf("You MUST BE ROOT to run this software"))
-	}
-
-	switch command {
-	case "start":
-
-		fl.Parse(args[1:])
-
-		if len(args) > 1 {
-			tools.SaveFlags(args[1:])
-		}
-
-		signal.Notify(sigs, os.Interrupt)
-		go func() {
-			// clean system on interrupt
-			sig := <-sigs
-			logger.Println("Caught:", sig)
-			once.Do(close)
-			os.Exit(1)
-		}()
-
-		logger.Println("Starting Hidemego Service to Anonymize the System")
-		initialize()
-		nontor := tor.NonTor()
-		var countries string = tor.Countries
-
-		var err error
-		if torID == 0 {
-			logger.Println("Detecting Tor ID...")
-			if torID, err = tor.ID(); err != nil {
-				logger.Fatal("Can't Automatically Detect Tor ID:", err)
-			}
-			logger.Println(fmt.Sprintf("Tor ID found: %d", torID))
-		}
-
-		if torUser == "" {
-			logger.Println("Detecting Tor User...")
-			torUser, err = tor.Usr()
-			if err != nil {
-				logger.Fatal("Can't Automatically Detect Tor User:", err)
-			}
-			logger.Println(fmt.Sprintf("Tor User found: %s", torUser))
-		}
-
-		if no5 {
-			logger.Println("Skipping node families from 5 eyes countries")
-			countries = tor.NoEyes(tor.Eyes5C)
-		} else if no9 {
-			logger.Println("Skipping node families from 9 eyes countries")
-			countries = tor.NoEyes(tor.Eyes9C)
-		} else if no14 {
-			logger.Println("Skipping node families from 14 eyes countries")
-			countries = tor.NoEyes(tor.Eyes14C)
-		} else if no14p {
-			logger.Println("Skipping node families from 14 eyes countries and others bad countries")
-			countries = tor.NoEyes(tor.Eyes14CPlus)
-		}
-
-		logger.Println("Setting up Hidemego TorRC...")
-		if torPass != "" {
-			if err := tor.SetTorRC(countries, torPort, socksDestPort, socksAuthPort, controlPort, dnsPort, torUser, torPass); err != nil {
-				logger.Fatal("Can't Setup Hidemego TorRC")
-			}
-		} else {
-			if err := tor.SetTorRC(countries, torPort, socksDestPort, socksAuthPort, controlPort, dnsPort, torUser); err != nil {
-				logger.Fatal("Can't Setup Hidemego TorRC")
-			}
-		}
-
-		if ifaces != "" {
-			var ifa []string = []string{}
-
-			logger.Println("Changing MAC Address for", ifaces)
-			tifa := strings.Split(ifaces, ",")
-			for _, t := range tifa {
-				if t != "" {
-					ifa = append(ifa, t)
-				}
-			}
-			for _, r := range ifa {
-				if !linux.HasIface(r) {
-					logger.Println(fmt.Sprintf("Invalid Network Interface %s Found! Skipping", r))
-					continue
-				}
-				logger.Println("Generating MAC Address for", r)
-				mac, err := tools.RandMACAddr()
-				if err != nil {
-					logger.Fatal("Could not Generate Random MAC Address for", r, err)
-				}
-				logger.Println("Assigning", mac, "to", r)
-				if err := linux.IPSet(r, "down"); err != nil {
-					logger.Fatal(err)
-				}
-				if err := linux.IPSetMACAddr(r, mac); err != nil {
-					logger.Fatal(err)
-				}
-				if err := linux.IPSet(r, "up"); err != nil {
-					logger.Fatal(err)
-				}
-			}
-		}
-		logger.Println("Changing resolv.conf...")
-		if err := linux.SetResolvConf(); err != nil {
-			logger.Fatal("Can't Change resolv.conf:", err)
-		}
-		logger.Println("Restarting Tor Service")
-		if tor.Restart(); err != nil {
-			logger.Fatal("Can't Restart Tor Service:", err)
-		}
-		logger.Println("Setting Up IPTables Rules")
-		if err := linux.SetIPTablesRules(nontor, torID, torPort, dnsPort); err != nil {
-			logger.Fatal("Can't Setup IPTables Rules", err)
-		}
-		time.Sleep(3 * time.Second)
-		if tools.CheckConn() {
-			ip, err := tools.GetIPAddress()
-			if err != nil {
-				logger.Fatal("Could Not Get IP Address:", err)
-			}
-			logger.Println("Your new IP Address is", ip)
-		}
-	case "new":
-		logger.Println("Changing Your Identity")
-		ip, err := tor.ChangeIdentity(torPass, torPort)
+// Returns the interfaces that must change MAC Address, expanding "*" to
+// every physical interface
+func sessionIfaces(cfg config.Config) []string {
+	if len(cfg.Network.Ifaces) == 1 && cfg.Network.Ifaces[0] == "*" {
+		ifaces, err := linux.PhysicalIfaces()
 		if err != nil {
-			logger.Fatal("Can't Change Your Identity:", err)
+			logger.Println("Can't List Network Interfaces:", err)
 		}
-		logger.Println("Your New IP Address is", ip)
-	case "stop":
-		close()
-	default:
-		fl.Usage()
+		return ifaces
 	}
+	return cfg.Network.Ifaces
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
 }
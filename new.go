@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/multiversecoder/hidemego/config"
+	"github.com/multiversecoder/hidemego/tor"
+)
+
+// exits used by the previous identities, most recent first
+var exitsFile = path.Join(confDir, "exits")
+
+func init() {
+	register(&command{
+		Name:  "new",
+		Short: "Change the Tor identity and get a new exit node",
+		Long: `
+Changes the Tor identity through the control port: a NEWNYM signal is sent,
+the open general circuits and their streams are closed and hidemego waits
+until Tor builds a circuit whose exit node differs from the ones in use. The
+onion service and internal circuits are kept. With -exclude-last the exit
+nodes of the previous identities are added to ExcludeExitNodes, so no circuit
+uses them again until Tor reloads its configuration.
+
+The new exit node is reported with its address and country.`,
+		Examples: []string{
+			"hidemego new",
+			"hidemego new -exclude-last=5",
+			"hidemego new -pass=secret -cport=9052"},
+		Root: true,
+		Flags: func(fs *flag.FlagSet) {
+			fs.String("pass", "", "The Tor Control Authentication Password (default: the session password)")
+			fs.Int("cport", 0, "Tor Control Port (default: the session control port)")
+			fs.Int("exclude-last", 0, "Number of previous exit nodes never selected again (default: the session identity.exclude_last)")
+			fs.Duration("timeout", time.Minute, "Time to wait for a circuit with a new exit node")
+		},
+		Run: func(fs *flag.FlagSet) int {
+			cfg, err := loadSession()
+			if err != nil {
+				logger.Println("Can't Load Hidemego Session:", err)
+				return exitFailure
+			}
+			fs.Visit(func(f *flag.Flag) {
+				if key, ok := flagKeys[f.Name]; ok && err == nil {
+					err = cfg.Set(key, f.Value.String())
+				}
+			})
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if err != nil {
+				logger.Println(err)
+				return exitUsage
+			}
+			logger.Println("Changing Your Identity")
+			timeout := fs.Lookup("timeout").Value.(flag.Getter).Get().(time.Duration)
+			exit, err := newIdentity(cfg, timeout)
+			if err != nil {
+				logger.Println("Can't Change Your Identity:", err)
+				return exitFailure
+			}
+			logExit(exit)
+			return exitOK
+		}})
+}
+
+// Changes identity waiting for a new exit node, the exit is located when
+// possible and remembered for identity.exclude_last
+func newIdentity(cfg config.Config, timeout time.Duration) (tor.Relay, error) {
+	c, err := tor.OpenControl(cfg.Tor.ControlPort, cfg.Tor.ControlPassword)
+	if err != nil {
+		return tor.Relay{}, fmt.Errorf("can't connect to the tor control port: %v", err)
+	}
+	defer c.Close()
+	exits := readExits()
+	exclude := exits
+	if len(exclude) > cfg.Identity.ExcludeLast {
+		exclude = exclude[:cfg.Identity.ExcludeLast]
+	}
+	// the previous exits stay excluded for the following circuits too
+	sel, err := cfg.NodePolicy().Selection()
+	if err != nil {
+		return tor.Relay{}, err
+	}
+	if err := c.ExcludeExits(sel.ExcludeExitNodes, exclude); err != nil {
+		return tor.Relay{}, fmt.Errorf("can't exclude the previous exit nodes: %v", err)
+	}
+	exit, err := tor.NewExit(c, exclude, timeout)
+	if err != nil {
+		return exit, err
+	}
+	if err := saveExits(append([]string{exit.Fingerprint}, exits...)); err != nil {
+		logger.Println("Can't Save the Exit Node:", err)
+	}
+	if err := c.Locate(&exit); err != nil {
+		logger.Println("Can't Locate the Exit Node:", err)
+	}
+	return exit, nil
+}
+
+// Logs the exit node, its country and address
+func logExit(exit tor.Relay) {
+	if exit.Addr == "" {
+		logger.Println("Your New Exit Node is", exit.Nickname, exit.Fingerprint)
+		return
+	}
+	country := exit.Country
+	if name, ok := tor.CountryName(exit.Country); ok {
+		country = name + " (" + exit.Country + ")"
+	}
+	logger.Printf("Your New Exit Node is %s %s in %s\n", exit.Nickname, exit.Fingerprint, country)
+	logger.Println("Your New IP Address is", exit.Addr)
+}
+
+// Reads the exit fingerprints of the previous identities
+func readExits() []string {
+	b, err := ioutil.ReadFile(exitsFile)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(b))
+}
+
+// Saves the most recent exit fingerprints
+func saveExits(exits []string) error {
+	if len(exits) > config.MaxExcludeLast {
+		exits = exits[:config.MaxExcludeLast]
+	}
+	return ioutil.WriteFile(exitsFile, []byte(strings.Join(exits, "\n")+"\n"), 0600)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/multiversecoder/hidemego/config"
+	"github.com/multiversecoder/hidemego/tor"
+)
+
+func init() {
+	register(&command{
+		Name:  "onion",
+		Args:  "<add|list|remove|export|backup|restore> [name|address] [file]",
+		Short: "Publish onion services through the hidemego Tor",
+		Long: `
+add publishes an onion service forwarding its -port ports to local targets.
+By default the service is ephemeral: it is added through the control port
+with ADD_ONION and disappears when Tor stops, its key is discarded unless
+-export saves it. With -persistent and -name the service gets a
+HiddenServiceDir under the hidemego Tor data directory, it is published by
+every session and kept by stop. Its key is generated by hidemego, so the
+address is printed even when no session is running. -key imports an existing v3 key, either a
+hs_ed25519_secret_key file or an ED25519-V3:<base64> key, so the service
+keeps its address. -client-auth restricts the service to the clients owning
+the given x25519 keys.
+
+list shows the persistent and the ephemeral services, remove deletes a
+persistent service by name or an ephemeral one by address, export writes the
+key of a persistent service to a file in the hs_ed25519_secret_key format.
+
+backup writes the keys, the ports and the authorized clients of a persistent
+service to a file encrypted with a passphrase (PBKDF2-SHA256 and
+AES-256-GCM), restore creates the service again from it, with -name under a
+different name.`,
+		Examples: []string{
+			"hidemego onion add -port=80:127.0.0.1:8080",
+			"hidemego onion add -persistent -name=blog -port=80:127.0.0.1:8080,443:127.0.0.1:8443",
+			"hidemego onion add -persistent -name=ssh -port=22 -key=./hs_ed25519_secret_key",
+			"hidemego onion add -port=80:unix:/run/app.sock -client-auth=N2NU7BSRL6YODZCYPN4CREB54TYLKGIE2KYOQWLFYC23ZJVCE5DQ",
+			"hidemego onion list",
+			"hidemego onion remove blog",
+			"hidemego onion export blog ./blog.key",
+			"hidemego onion backup blog ./blog.backup",
+			"hidemego onion restore -name=blog2 ./blog.backup"},
+		Root: true,
+		Flags: func(fs *flag.FlagSet) {
+			fs.String("port", "", "Ports of the service, comma separated virtual[:target], e.g. 80:127.0.0.1:8080")
+			fs.Bool("persistent", false, "Keep the service and its key across sessions")
+			fs.String("name", "", "Name of the persistent service")
+			fs.String("key", "", "Secret key file to import, a hs_ed25519_secret_key file or an ED25519-V3:<base64> key")
+			fs.String("export", "", "File the secret key of a new ephemeral service is written to")
+			fs.String("client-auth", "", "Base32 x25519 public keys of the authorized clients, comma separated")
+			fs.String("passphrase-file", "", "File with the passphrase of backup and restore (default: ask on the terminal)")
+			fs.Duration("timeout", 30*time.Second, "Time to wait for Tor to publish a persistent service")
+			fs.String("pass", "", "The Tor Control Authentication Password (default: the session password)")
+			fs.Int("cport", 0, "Tor Control Port (default: the session control port)")
+		},
+		Run: runOnion})
+}
+
+func runOnion(fs *flag.FlagSet) int {
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	action := fs.Arg(0)
+	// flags are accepted after the action too
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return exitUsage
+	}
+	args := fs.Args()
+	cfg, err := loadSession()
+	if err != nil {
+		logger.Println("Can't Load Hidemego Session:", err)
+		return exitFailure
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := flagKeys[f.Name]; ok && err == nil {
+			err = cfg.Set(key, f.Value.String())
+		}
+	})
+	if err != nil {
+		logger.Println(err)
+		return exitUsage
+	}
+	switch {
+	case action == "add" && len(args) == 0:
+		return onionAdd(fs, cfg)
+	case action == "list" && len(args) == 0:
+		return onionList(cfg)
+	case action == "remove" && len(args) == 1:
+		return onionRemove(cfg, args[0])
+	case action == "export" && len(args) == 2:
+		return onionExport(args[0], args[1])
+	case action == "backup" && len(args) == 2:
+		return onionBackup(args[0], args[1], fs.Lookup("passphrase-file").Value.String())
+	case action == "restore" && len(args) == 1:
+		return onionRestore(fs, cfg, args[0])
+	case action == "add" || action == "list" || action == "remove" || action == "export" ||
+		action == "backup" || action == "restore":
+		fs.Usage()
+		return exitUsage
+	}
+	fmt.Fprintf(os.Stderr, "hidemego: unknown onion action %q\n\n", action)
+	fs.Usage()
+	return exitUsage
+}
+
+func onionAdd(fs *flag.FlagSet, cfg config.Config) int {
+	flagValue := func(name string) string {
+		return fs.Lookup(name).Value.String()
+	}
+	var o tor.Onion
+	for _, s := range strings.Split(flagValue("port"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := tor.ParseOnionPort(s)
+		if err != nil {
+			logger.Println(err)
+			return exitUsage
+		}
+		o.Ports = append(o.Ports, p)
+	}
+	for _, k := range strings.Split(flagValue("client-auth"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			o.ClientAuth = append(o.ClientAuth, k)
+		}
+	}
+	persistent := flagValue("persistent") == "true"
+	o.Name = flagValue("name")
+	switch {
+	case persistent && o.Name == "":
+		logger.Println("A persistent onion service needs -name")
+		return exitUsage
+	case !persistent && o.Name != "":
+		logger.Println("-name is only valid with -persistent")
+		return exitUsage
+	case persistent && flagValue("export") != "":
+		logger.Println("-export is only valid for ephemeral services, use onion export")
+		return exitUsage
+	}
+	if err := o.Validate(); err != nil {
+		logger.Println(err)
+		return exitUsage
+	}
+	var key []byte
+	if f := flagValue("key"); f != "" {
+		var err error
+		if key, err = tor.ReadOnionKey(f); err != nil {
+			logger.Println("Can't Read the Onion Service Key:", err)
+			return exitFailure
+		}
+	}
+
+	if persistent {
+		o, err := tor.CreateOnion(o, key)
+		if err != nil {
+			logger.Println("Can't Create the Onion Service:", err)
+			return exitFailure
+		}
+		return publish(cfg, o, fs.Lookup("timeout").Value.(flag.Getter).Get().(time.Duration))
+	}
+
+	c, err := tor.OpenControl(cfg.Tor.ControlPort, cfg.Tor.ControlPassword)
+	if err != nil {
+		logger.Println("Can't Connect to the Tor Control Port:", err)
+		return exitFailure
+	}
+	defer c.Close()
+	export := flagValue("export")
+	o, key, err = c.AddOnion(o, key, export != "")
+	if err != nil {
+		logger.Println("Can't Add the Onion Service:", err)
+		return exitFailure
+	}
+	if export != "" {
+		if err := tor.WriteOnionKey(export, key); err != nil {
+			logger.Println("Can't Export the Onion Service Key:", err)
+			c.DelOnion(o.ServiceID)
+			return exitFailure
+		}
+		logger.Println("Onion Service Key Written to", export)
+	}
+	fmt.Println(o.Address())
+	return exitOK
+}
+
+func onionList(cfg config.Config) int {
+	onions, err := tor.Onions()
+	if err != nil {
+		logger.Println("Can't Read the Onion Services:", err)
+		return exitFailure
+	}
+	for _, o := range onions {
+		addr := o.Address()
+		if addr == "" {
+			addr = "-"
+		}
+		var ports []string
+		for _, p := range o.Ports {
+			ports = append(ports, p.String())
+		}
+		auth := ""
+		if len(o.ClientAuth) > 0 {
+			auth = fmt.Sprintf("\t%d authorized clients", len(o.ClientAuth))
+		}
+		fmt.Printf("%s\t%s\t%s%s\n", addr, o.Name, strings.Join(ports, ","), auth)
+	}
+	if _, err := os.Stat(sessionFile); os.IsNotExist(err) {
+		return exitOK
+	}
+	c, err := tor.OpenControl(cfg.Tor.ControlPort, cfg.Tor.ControlPassword)
+	if err != nil {
+		logger.Println("Can't Connect to the Tor Control Port:", err)
+		return exitFailure
+	}
+	defer c.Close()
+	ids, err := c.EphemeralOnions()
+	if err != nil {
+		logger.Println("Can't List the Ephemeral Onion Services:", err)
+		return exitFailure
+	}
+	for _, id := range ids {
+		fmt.Printf("%s.onion\tephemeral\n", id)
+	}
+	return exitOK
+}
+
+func onionRemove(cfg config.Config, target string) int {
+	if !strings.HasSuffix(target, ".onion") {
+		if err := tor.RemoveOnion(target); err != nil {
+			logger.Println("Can't Remove the Onion Service:", err)
+			return exitFailure
+		}
+		logger.Println("Onion Service", target, "Removed")
+		if _, err := os.Stat(sessionFile); err == nil {
+			if err := republish(cfg); err != nil {
+				logger.Println("Can't Reload Tor:", err)
+				return exitFailure
+			}
+		}
+		return exitOK
+	}
+	// a persistent service can be removed by address too
+	onions, err := tor.Onions()
+	if err != nil {
+		logger.Println("Can't Read the Onion Services:", err)
+		return exitFailure
+	}
+	for _, o := range onions {
+		if o.Address() == target {
+			return onionRemove(cfg, o.Name)
+		}
+	}
+	c, err := tor.OpenControl(cfg.Tor.ControlPort, cfg.Tor.ControlPassword)
+	if err != nil {
+		logger.Println("Can't Connect to the Tor Control Port:", err)
+		return exitFailure
+	}
+	defer c.Close()
+	if err := c.DelOnion(target); err != nil {
+		logger.Println("Can't Remove the Onion Service:", err)
+		return exitFailure
+	}
+	logger.Println("Onion Service", target, "Removed")
+	return exitOK
+}
+
+func onionExport(name, file string) int {
+	o, err := tor.ReadOnion(name)
+	if err != nil {
+		logger.Println("Can't Read the Onion Service:", err)
+		return exitFailure
+	}
+	key, err := tor.ReadOnionKey(path.Join(o.Dir(), "hs_ed25519_secret_key"))
+	if err != nil {
+		logger.Println("Can't Read the Onion Service Key:", err)
+		return exitFailure
+	}
+	if err := tor.WriteOnionKey(file, key); err != nil {
+		logger.Println("Can't Export the Onion Service Key:", err)
+		return exitFailure
+	}
+	logger.Println("Onion Service Key Written to", file)
+	return exitOK
+}
+
+func onionBackup(name, file, passFile string) int {
+	pass, err := readPassphrase(passFile, true)
+	if err != nil {
+		logger.Println("Can't Read the Passphrase:", err)
+		return exitFailure
+	}
+	b, err := tor.BackupOnion(name, pass)
+	if err != nil {
+		logger.Println("Can't Backup the Onion Service:", err)
+		return exitFailure
+	}
+	if err := ioutil.WriteFile(file, b, 0600); err != nil {
+		logger.Println("Can't Write the Backup:", err)
+		return exitFailure
+	}
+	logger.Println("Onion Service", name, "Backed Up to", file)
+	return exitOK
+}
+
+func onionRestore(fs *flag.FlagSet, cfg config.Config, file string) int {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		logger.Println("Can't Read the Backup:", err)
+		return exitFailure
+	}
+	pass, err := readPassphrase(fs.Lookup("passphrase-file").Value.String(), false)
+	if err != nil {
+		logger.Println("Can't Read the Passphrase:", err)
+		return exitFailure
+	}
+	o, err := tor.RestoreOnion(b, pass, fs.Lookup("name").Value.String())
+	if err != nil {
+		logger.Println("Can't Restore the Onion Service:", err)
+		return exitFailure
+	}
+	return publish(cfg, o, fs.Lookup("timeout").Value.(flag.Getter).Get().(time.Duration))
+}
+
+// Publishes a new persistent service through the running session and
+// prints its address, tor derives the address of an imported key
+func publish(cfg config.Config, o tor.Onion, timeout time.Duration) int {
+	logger.Println("Onion Service", o.Name, "Created in", o.Dir())
+	if _, err := os.Stat(sessionFile); os.IsNotExist(err) {
+		logger.Println("The Onion Service Is Published by the Next Session")
+		if o.ServiceID != "" {
+			fmt.Println(o.Address())
+		}
+		return exitOK
+	}
+	if err := republish(cfg); err != nil {
+		logger.Println("Can't Publish the Onion Service:", err)
+		return exitFailure
+	}
+	for start := time.Now(); o.ServiceID == "" && time.Since(start) < timeout; time.Sleep(time.Second) {
+		if r, err := tor.ReadOnion(o.Name); err == nil {
+			o = r
+		}
+	}
+	if o.ServiceID == "" {
+		logger.Println("Tor Didn't Publish the Onion Service in", timeout)
+		return exitFailure
+	}
+	fmt.Println(o.Address())
+	return exitOK
+}
+
+// Reads the backup passphrase from the first line of file or, when file is
+// empty, from the terminal without echo asking it twice if confirm is true
+func readPassphrase(file string, confirm bool) ([]byte, error) {
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(strings.SplitN(string(b), "\n", 2)[0], "\r")), nil
+	}
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}
+	stty("-echo")
+	defer stty("echo")
+	r := bufio.NewReader(os.Stdin)
+	read := func(prompt string) (string, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		line, err := r.ReadString('\n')
+		fmt.Fprintln(os.Stderr)
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	pass, err := read("Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		again, err := read("Repeat the Passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if again != pass {
+			return nil, fmt.Errorf("the passphrases don't match")
+		}
+	}
+	return []byte(pass), nil
+}
+
+// Rewrites the torrc of the running session with the persistent onion
+// services and makes tor reload it
+func republish(cfg config.Config) error {
+	rc, err := torRC(cfg)
+	if err != nil {
+		return err
+	}
+	if err := tor.SetTorRC(rc); err != nil {
+		return fmt.Errorf("can't setup the hidemego torrc: %v", err)
+	}
+	return tor.Reload()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/multiversecoder/hidemego/config"
+	"github.com/multiversecoder/hidemego/tor"
+)
+
+func init() {
+	register(&command{
+		Name:  "rotate",
+		Short: "Change the Tor identity at regular intervals",
+		Long: `
+Sends a NEWNYM signal to the Tor control port every -every interval until it
+is interrupted, or -count times. After each signal the exit IP address is
+checked through the Tor SocksAuthPort and the signal is sent again, respecting the Tor NEWNYM rate limit,
+until the address changes or -attempts signals were sent.
+
+The interval defaults to identity.rotate_every of the session configuration.
+With -count=1 the command changes the identity once and exits, e.g. when run
+by a systemd timer.`,
+		Examples: []string{
+			"hidemego rotate -every=10m",
+			"hidemego rotate -every=30s -count=20",
+			"hidemego rotate -count=1"},
+		Root: true,
+		Flags: func(fs *flag.FlagSet) {
+			fs.Duration("every", 0, "Interval between two identity changes (default: the session identity.rotate_every)")
+			fs.Int("attempts", 0, "NEWNYM signals sent until the exit IP address changes (default: the session identity.attempts)")
+			fs.Int("count", 0, "Number of identity changes, 0 rotates until interrupted")
+			fs.String("pass", "", "The Tor Control Authentication Password (default: the session password)")
+			fs.Int("cport", 0, "Tor Control Port (default: the session control port)")
+		},
+		Run: func(fs *flag.FlagSet) int {
+			cfg, err := loadSession()
+			if err != nil {
+				logger.Println("Can't Load Hidemego Session:", err)
+				return exitFailure
+			}
+			fs.Visit(func(f *flag.Flag) {
+				if key, ok := flagKeys[f.Name]; ok && err == nil {
+					err = cfg.Set(key, f.Value.String())
+				}
+			})
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if err != nil {
+				logger.Println(err)
+				return exitUsage
+			}
+			count := fs.Lookup("count").Value.(flag.Getter).Get().(int)
+			every := cfg.Identity.RotateEvery
+			if count < 0 {
+				logger.Println("-count must not be negative")
+				return exitUsage
+			}
+			if every == 0 && count != 1 {
+				logger.Println("No rotation interval, use -every or identity.rotate_every")
+				return exitUsage
+			}
+			ip, err := tor.ExitIP(socksAuthAddr(cfg), time.Minute)
+			if err != nil {
+				logger.Println("Can't Get Your IP Address:", err)
+				return exitFailure
+			}
+			logger.Println("Your Current IP Address is", ip)
+			sig := make(chan os.Signal, 1)
+			var tick <-chan time.Time
+			if count != 1 {
+				signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+				logger.Println("Changing Your Identity Every", every)
+				ticker := time.NewTicker(every)
+				defer ticker.Stop()
+				tick = ticker.C
+			}
+			for n := 1; ; n++ {
+				if count != 1 {
+					select {
+					case <-sig:
+						logger.Println("Identity Rotation Stopped")
+						return exitOK
+					case <-tick:
+					}
+				}
+				ip, err = rotate(cfg, ip)
+				if count == 1 && err != nil {
+					return exitFailure
+				}
+				if count > 0 && n >= count {
+					return exitOK
+				}
+			}
+		}})
+}
+
+// Changes the identity through the control port and logs the outcome,
+// returns the current exit IP address
+func rotate(cfg config.Config, ip string) (string, error) {
+	c, err := tor.OpenControl(cfg.Tor.ControlPort, cfg.Tor.ControlPassword)
+	if err != nil {
+		logger.Println("Can't Connect to the Tor Control Port:", err)
+		return ip, err
+	}
+	defer c.Close()
+	nip, err := tor.RotateIdentity(c, socksAuthAddr(cfg), ip, cfg.Identity.Attempts)
+	if err != nil {
+		logger.Println("Can't Change Your Identity:", err)
+		return nip, err
+	}
+	logger.Printf("Identity Changed: %s -> %s\n", ip, nip)
+	return nip, nil
+}
+
+// Returns the address of the tor SocksAuthPort of cfg
+func socksAuthAddr(cfg config.Config) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(cfg.Tor.SocksAuthPort))
+}
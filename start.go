@@ -0,0 +1,436 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/multiversecoder/hidemego/config"
+	"github.com/multiversecoder/hidemego/linux"
+	"github.com/multiversecoder/hidemego/tools"
+	"github.com/multiversecoder/hidemego/tor"
+)
+
+func init() {
+	register(&command{
+		Name:  "start",
+		Short: "Anonymize the system routing all traffic through Tor",
+		Long: `
+Starts a hidemego session: writes the hidemego torrc, restarts Tor, changes
+resolv.conf, hardens the kernel and redirects all TCP and DNS traffic to Tor
+using iptables.
+
+The settings are read from the configuration file and the given profile, the
+flags override them. The resulting session is saved so that 'hidemego stop'
+can revert it.`,
+		Examples: []string{
+			"hidemego start",
+			"hidemego start -no5",
+			"hidemego start -exclude-countries=us,gb,@14eyes -exit-countries=ch,is",
+			"hidemego start -profile=paranoid",
+			"hidemego start -profile=censorship -bridges=/etc/hidemego/bridges.txt",
+			"hidemego start -upstream-proxy=http://192.0.2.10:3128 -upstream-proxy-credentials=/etc/hidemego/proxy.cred",
+			"hidemego start -config=/etc/hidemego/hidemego.toml -profile=work",
+			"hidemego start -ifaces=enp1s0,wlo1"},
+		Root:  true,
+		Flags: sessionFlags,
+		Run:   start})
+}
+
+func initialize(cfg config.Config) {
+	if ok, _ := tools.Exists("tor"); !ok {
+		logger.Fatal(fmt.Errorf("fatal error: Tor is not installed"))
+	}
+	if ok, _ := tools.Exists("NetworkManager"); !ok {
+		logger.Fatal("fatal error: NetworkManager is not installed")
+	}
+	if _, err := os.Stat("/run/tor"); os.IsNotExist(err) {
+		os.Mkdir("/run/tor", 0700)
+	}
+	if _, err := os.Stat("/var/lib/tor/hidemego"); os.IsNotExist(err) {
+		os.Mkdir("/var/lib/tor/hidemego", 0700)
+	}
+	if ok, _ := tools.Exists("setenforce"); ok {
+		if err := tor.ChangeDirOwner("/run/tor"); err != nil {
+			logger.Fatal("Can't Change Dir Owner on /run/tor", err)
+		}
+		if err := tor.ChangeDirOwner("/var/lib/tor"); err != nil {
+			logger.Fatal("Can't Change Dir Owner on /var/lib/tor", err)
+		}
+		if err := tor.ChangeDirOwner("/var/run/tor"); err != nil {
+			logger.Fatal("Can't Change Dir Owner on /var/run/tor", err)
+		}
+		if err := tor.ChangeDirOwner("/var/lib/tor/hidemego"); err != nil {
+			logger.Fatal("Can't Change Dir Owner on /var/lib/tor/hidemego", err)
+		}
+		if !linux.HasSELPort(cfg.Tor.SocksDestPort) {
+			logger.Println(fmt.Sprintf("Opening TCP Sock Dest Port on %d", cfg.Tor.SocksDestPort))
+			if err := linux.SELManage(cfg.Tor.SocksDestPort, true); err != nil {
+				logger.Fatal(err)
+			} // socks dest
+		}
+		if !linux.HasSELPort(cfg.Tor.SocksAuthPort) {
+			logger.Println(fmt.Sprintf("Opening TCP Sock Auth Port on %d", cfg.Tor.SocksAuthPort))
+			if err := linux.SELManage(cfg.Tor.SocksAuthPort, true); err != nil {
+				logger.Fatal(err)
+			} // socks auth
+		}
+		if !linux.HasSELPort(cfg.Tor.ControlPort) {
+			logger.Println(fmt.Sprintf("Opening TCP Control Port on %d", cfg.Tor.ControlPort))
+			if err := linux.SELManage(cfg.Tor.ControlPort, true); err != nil {
+				logger.Fatal(err)
+			} // control
+		}
+		if !linux.HasSELPort(cfg.Tor.TransPort) {
+			logger.Println(fmt.Sprintf("Opening TCP Port on %d", cfg.Tor.TransPort))
+			if err := linux.SELManage(cfg.Tor.TransPort, true); err != nil {
+				logger.Fatal(err)
+			} // transport
+		}
+		if !linux.HasSELPort(cfg.Tor.DNSPort) {
+			logger.Println(fmt.Sprintf("Opening TCP and UDP DNS Ports on %d", cfg.Tor.DNSPort))
+			if err := linux.SELManage(cfg.Tor.DNSPort, true, true); err != nil {
+				logger.Fatal(err)
+			} // dns
+		}
+		for _, name := range cfg.Isolation.ClassNames() {
+			if p := cfg.Isolation.Classes[name].Port; !linux.HasSELPort(p) {
+				logger.Println(fmt.Sprintf("Opening TCP Port on %d for %s", p, name))
+				if err := linux.SELManage(p, true); err != nil {
+					logger.Fatal(err)
+				}
+			}
+		}
+	}
+	if cfg.Kernel.Harden {
+		logger.Println("Saving Kernel Configuration")
+		if err := linux.SaveKernelConfigs(); err != nil {
+			logger.Println("Can't Save Kernel Configuration. Restart The System after `stop`")
+			os.RemoveAll(confDir)
+			logger.Println(err)
+		}
+		logger.Println("Securing Kernel")
+		linux.PrepareLinuxKernel()
+
+	}
+}
+
+// Labels the pluggable transports binaries on SELinux systems
+func labelTransportPlugins(plugins []tor.TransportPlugin) {
+	if ok, _ := tools.Exists("setenforce"); !ok {
+		return
+	}
+	for _, p := range plugins {
+		if linux.IsSELTorExec(p.Path) {
+			continue
+		}
+		logger.Println("Setting SELinux Context for", p.Path)
+		if err := linux.SELManageExec(p.Path, true); err != nil {
+			logger.Fatal(fmt.Sprintf("Can't Set SELinux Context for %s:", p.Path), err)
+		}
+	}
+}
+
+func start(fs *flag.FlagSet) int {
+	cfg, err := sessionConfig(fs)
+	if err != nil {
+		logger.Println("Invalid Configuration:", err)
+		return exitFailure
+	}
+	cfg = prepare(cfg)
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		// clean system on interrupt
+		sig := <-sigs
+		logger.Println("Caught:", sig)
+		once.Do(close)
+		os.Exit(1)
+	}()
+
+	setup(cfg)
+	if cfg.TimeSync.Enabled {
+		syncClock(cfg, false)
+	}
+	time.Sleep(3 * time.Second)
+	if tools.CheckConn(2 * time.Minute) {
+		ip, err := tools.GetIPAddress()
+		if err != nil {
+			logger.Fatal("Could Not Get IP Address:", err)
+		}
+		logger.Println("Your new IP Address is", ip)
+	}
+	return exitOK
+}
+
+// Detects the tor user and id missing from the configuration and saves the
+// session
+func prepare(cfg config.Config) config.Config {
+	var err error
+	if cfg.Profile != "" {
+		logger.Println("Using Profile", cfg.Profile)
+	}
+
+	if cfg.Tor.ID == 0 {
+		logger.Println("Detecting Tor ID...")
+		if cfg.Tor.ID, err = tor.ID(); err != nil {
+			logger.Fatal("Can't Automatically Detect Tor ID:", err)
+		}
+		logger.Println(fmt.Sprintf("Tor ID found: %d", cfg.Tor.ID))
+	}
+
+	if cfg.Tor.User == "" {
+		logger.Println("Detecting Tor User...")
+		cfg.Tor.User, err = tor.Usr()
+		if err != nil {
+			logger.Fatal("Can't Automatically Detect Tor User:", err)
+		}
+		logger.Println(fmt.Sprintf("Tor User found: %s", cfg.Tor.User))
+	}
+
+	if err := saveSession(cfg); err != nil {
+		logger.Fatal("Can't Save Hidemego Session:", err)
+	}
+	return cfg
+}
+
+// Anonymizes the system with the session configuration, returns the torrc
+// values in use and the recorded system state
+func setup(cfg config.Config) (tor.RC, linux.State) {
+	logger.Println("Starting Hidemego Service to Anonymize the System")
+	initialize(cfg)
+	rc, err := torRC(cfg)
+	if err != nil {
+		logger.Fatal("Can't Setup Hidemego TorRC:", err)
+	}
+	if cfg.Tor.UseBridges {
+		labelTransportPlugins(rc.TransportPlugins)
+	}
+	for _, o := range rc.Onions {
+		logger.Println("Publishing the Onion Service", o.Name)
+	}
+
+	logger.Println("Setting up Hidemego TorRC...")
+	if err := tor.SetTorRC(rc); err != nil {
+		logger.Fatal("Can't Setup Hidemego TorRC")
+	}
+	logger.Println("Installing the", tor.ServiceName, "Unit")
+	if err := tor.InstallUnit(); err != nil {
+		logger.Fatal("Can't Install the Tor Unit:", err)
+	}
+
+	var changed []string
+	if ifaces := sessionIfaces(cfg); len(ifaces) > 0 {
+		logger.Println("Changing MAC Address for", strings.Join(ifaces, ","))
+		for _, r := range ifaces {
+			if !linux.HasIface(r) {
+				logger.Println(fmt.Sprintf("Invalid Network Interface %s Found! Skipping", r))
+				continue
+			}
+			logger.Println("Generating MAC Address for", r)
+			mac, err := tools.RandMACAddr()
+			if err != nil {
+				logger.Fatal("Could not Generate Random MAC Address for", r, err)
+			}
+			logger.Println("Assigning", mac, "to", r)
+			if err := linux.IPSet(r, "down"); err != nil {
+				logger.Fatal(err)
+			}
+			if err := linux.IPSetMACAddr(r, mac); err != nil {
+				logger.Fatal(err)
+			}
+			if err := linux.IPSet(r, "up"); err != nil {
+				logger.Fatal(err)
+			}
+			changed = append(changed, r)
+		}
+	}
+	if g := cfg.Gateway.Iface; g != "" {
+		logger.Println("Enabling Forwarding on", g)
+		if err := linux.EnableForwarding(g); err != nil {
+			logger.Fatal("Can't Enable Forwarding on", g+":", err)
+		}
+	}
+	logger.Println("Changing resolv.conf...")
+	if err := linux.SetResolvConf(); err != nil {
+		logger.Fatal("Can't Change resolv.conf:", err)
+	}
+	logger.Println("Restarting Tor Service")
+	if err := tor.Restart(); err != nil {
+		logger.Fatal("Can't Restart Tor Service:", err)
+	}
+	logger.Println("Setting Up IPTables Rules")
+	if cfg.Firewall.KillSwitch {
+		logger.Println("Enabling Kill Switch")
+	}
+	if err := linux.SetIPTablesRules(firewall(cfg, rc)); err != nil {
+		logger.Fatal("Can't Setup IPTables Rules", err)
+	}
+	logger.Println("Recording the Session State")
+	st, err := record(cfg, changed)
+	if err != nil {
+		logger.Fatal("Can't Record the Session State:", err)
+	}
+	return rc, st
+}
+
+// Records the firewall rules, resolv.conf, the MAC addresses of ifaces and
+// the hardened sysctls applied by the session
+func record(cfg config.Config, ifaces []string) (linux.State, error) {
+	var sysctls []string
+	if cfg.Kernel.Harden {
+		for k := range linux.HardenedSysctls {
+			sysctls = append(sysctls, k)
+		}
+	}
+	if cfg.Gateway.Iface != "" {
+		sysctls = append(sysctls, linux.ForwardingSysctl(cfg.Gateway.Iface))
+	}
+	st, err := linux.Snapshot(ifaces, sysctls)
+	if err != nil {
+		return st, err
+	}
+	return st, saveState(st)
+}
+
+// Builds the torrc values of the session: node selection, bridges and the
+// resolved upstream proxy
+func torRC(cfg config.Config) (tor.RC, error) {
+	rc := tor.RC{
+		TransPort:           cfg.Tor.TransPort,
+		SocksDestPort:       cfg.Tor.SocksDestPort,
+		SocksAuthPort:       cfg.Tor.SocksAuthPort,
+		ControlPort:         cfg.Tor.ControlPort,
+		DNSPort:             cfg.Tor.DNSPort,
+		User:                cfg.Tor.User,
+		ControlPassword:     cfg.Tor.ControlPassword,
+		StrictNodes:         cfg.Tor.StrictNodes,
+		MaxCircuitDirtiness: int(cfg.Tor.MaxCircuitDirtiness.Seconds()),
+		CacheDNS:            cfg.DNS.Cache,
+		UseBridges:          cfg.Tor.UseBridges}
+	var err error
+	if rc.Nodes, err = cfg.NodePolicy().Selection(); err != nil {
+		return rc, fmt.Errorf("invalid node policy: %v", err)
+	}
+	if rc.Nodes.ExcludeNodes != "" {
+		logger.Println("Excluding nodes from", rc.Nodes.ExcludeNodes)
+	}
+	if rc.Nodes.ExcludeExitNodes != "" {
+		logger.Println("Excluding exit nodes from", rc.Nodes.ExcludeExitNodes)
+	}
+
+	if cfg.Tor.UseBridges {
+		if rc.Bridges, err = cfg.BridgeLines(); err != nil {
+			return rc, fmt.Errorf("invalid bridges: %v", err)
+		}
+		logger.Println(fmt.Sprintf("Using %d Bridges", len(rc.Bridges)))
+		if rc.TransportPlugins, err = tor.TransportPlugins(rc.Bridges); err != nil {
+			return rc, fmt.Errorf("can't find pluggable transports: %v", err)
+		}
+		for _, p := range rc.TransportPlugins {
+			logger.Println("Using", p.Path, "for", strings.Join(p.Transports, ","))
+		}
+	}
+
+	if g := cfg.Gateway.Iface; g != "" {
+		addr, err := linux.IfaceIPv4(g)
+		if err != nil {
+			return rc, fmt.Errorf("invalid gateway interface: %v", err)
+		}
+		logger.Println("Routing the Clients of", g, addr, "Through Tor")
+		rc.Gateways = append(rc.Gateways, tor.Gateway{Iface: g, Addr: addr})
+	}
+	for _, n := range cfg.Containers.Networks {
+		br, err := linux.ContainerBridge(n)
+		if err != nil {
+			return rc, fmt.Errorf("invalid container network: %v", err)
+		}
+		addr, err := linux.IfaceIPv4(br)
+		if err != nil {
+			return rc, fmt.Errorf("invalid container network %s: %v", n, err)
+		}
+		logger.Println("Routing the Containers of", n, "("+br+")", "Through Tor")
+		rc.Gateways = append(rc.Gateways, tor.Gateway{Iface: br, Addr: addr, Container: true})
+	}
+
+	if rc.TransFlags, err = tor.IsolationFlags(cfg.Isolation.TransPort); err != nil {
+		return rc, fmt.Errorf("invalid isolation: %v", err)
+	}
+	if rc.SocksDestFlags, err = tor.IsolationFlags(cfg.Isolation.SocksDestPort); err != nil {
+		return rc, fmt.Errorf("invalid isolation: %v", err)
+	}
+	if rc.SocksAuthFlags, err = tor.IsolationFlags(cfg.Isolation.SocksAuthPort); err != nil {
+		return rc, fmt.Errorf("invalid isolation: %v", err)
+	}
+	for _, name := range cfg.Isolation.ClassNames() {
+		cl := cfg.Isolation.Classes[name]
+		p := tor.IsolatedPort{Port: cl.Port, Flags: rc.TransFlags}
+		if len(cl.Isolation) > 0 {
+			if p.Flags, err = tor.IsolationFlags(cl.Isolation); err != nil {
+				return rc, fmt.Errorf("invalid isolation of %s: %v", name, err)
+			}
+		}
+		rc.IsolatedPorts = append(rc.IsolatedPorts, p)
+	}
+
+	if rc.Onions, err = tor.Onions(); err != nil {
+		return rc, fmt.Errorf("can't read the onion services: %v", err)
+	}
+
+	if rc.Proxy, err = cfg.Proxy(); err != nil {
+		return rc, fmt.Errorf("invalid upstream proxy: %v", err)
+	}
+	if rc.Proxy != nil {
+		if err := rc.Proxy.Resolve(); err != nil {
+			return rc, fmt.Errorf("can't resolve upstream proxy: %v", err)
+		}
+		logger.Println("Using Upstream Proxy", rc.Proxy.Type, rc.Proxy.Addr())
+	}
+	return rc, nil
+}
+
+// Returns the firewall rules of the session
+func firewall(cfg config.Config, rc tor.RC) linux.Firewall {
+	fw := linux.Firewall{
+		ExcludedTorAddrs: tor.NonTor(),
+		TorID:            cfg.Tor.ID,
+		TorPort:          cfg.Tor.TransPort,
+		DNSPort:          cfg.Tor.DNSPort,
+		KillSwitch:       cfg.Firewall.KillSwitch,
+		UDPPolicy:        cfg.UDP.Policy,
+		UDPLogGroup:      cfg.UDP.NFLogGroup,
+		LogDropped:       cfg.Firewall.LogDropped,
+		LogGroup:         cfg.Firewall.LogGroup,
+		LogRate:          cfg.Firewall.LogRate,
+		Bypass: linux.Bypass{
+			Users:      cfg.SplitTunnel.Users,
+			Groups:     cfg.SplitTunnel.Groups,
+			CGroups:    cfg.SplitTunnel.CGroups,
+			Networks:   cfg.SplitTunnel.Networks,
+			TorifyOnly: cfg.SplitTunnel.Mode == "torify"}}
+	if rc.Proxy != nil {
+		fw.ProxyIP = rc.Proxy.Host
+		fw.ProxyPort = rc.Proxy.Port
+	}
+	for _, name := range cfg.Isolation.ClassNames() {
+		cl := cfg.Isolation.Classes[name]
+		fw.Isolated = append(fw.Isolated, linux.Isolated{
+			Port:      cl.Port,
+			Users:     cl.Users,
+			Groups:    cl.Groups,
+			DestPorts: cl.DestPorts})
+	}
+	// validated with the configuration
+	dests, _ := cfg.UDP.Destinations()
+	for _, d := range dests {
+		fw.UDPAllow = append(fw.UDPAllow, linux.UDPDest{Network: d.Network, Port: d.Port})
+	}
+	for _, g := range rc.Gateways {
+		fw.Gateways = append(fw.Gateways, linux.Gateway{Iface: g.Iface, Addr: g.Addr, Container: g.Container})
+	}
+	return fw
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/multiversecoder/hidemego/tor"
+)
+
+func init() {
+	register(&command{
+		Name:  "status",
+		Short: "Show the state of the hidemego daemon",
+		Long: `
+Asks the hidemego daemon for the state of the session: the daemon process,
+the Tor service, the last exit node selected by the daemon, the changes
+found by the last check and the packets matched by the UDP policy.`,
+		Examples: []string{
+			"hidemego status",
+			"hidemego status -json"},
+		Flags: func(fs *flag.FlagSet) {
+			fs.String("socket", socketFile, "Unix socket of the daemon API")
+			fs.Bool("json", false, "Print the status as JSON")
+		},
+		Run: func(fs *flag.FlagSet) int {
+			rsp, err := daemonCall(fs.Lookup("socket").Value.String(), "status")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "hidemego: the daemon is not reachable:", err)
+				return exitFailure
+			}
+			s := rsp.Status
+			if fs.Lookup("json").Value.String() == "true" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				enc.Encode(s)
+				return exitOK
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			defer w.Flush()
+			fmt.Fprintf(w, "daemon\trunning (pid %d) since %s\n", s.PID, s.Since.Format(time.RFC3339))
+			if s.Profile != "" {
+				fmt.Fprintf(w, "profile\t%s\n", s.Profile)
+			}
+			if s.TorPID != 0 {
+				fmt.Fprintf(w, "tor\t%s (pid %d)\n", s.Tor, s.TorPID)
+			} else {
+				fmt.Fprintf(w, "tor\t%s\n", s.Tor)
+			}
+			if e := s.Exit; e != nil {
+				country := e.Country
+				if name, ok := tor.CountryName(e.Country); ok {
+					country = name
+				}
+				fmt.Fprintf(w, "exit\t%s %s %s %s\n", e.Nickname, e.Fingerprint, e.Addr, country)
+			}
+			fmt.Fprintf(w, "udp policy\t%s\n", s.UDPPolicy)
+			for _, c := range s.UDP {
+				fmt.Fprintf(w, "udp %s\t%d packets, %d bytes\n", c.Name, c.Packets, c.Bytes)
+			}
+			if s.HTTPProxy != "" {
+				fmt.Fprintf(w, "http proxy\t%s\n", s.HTTPProxy)
+			}
+			if s.SOCKSProxy != "" {
+				fmt.Fprintf(w, "socks proxy\t%s\n", s.SOCKSProxy)
+			}
+			if !s.TimeSync.IsZero() {
+				fmt.Fprintf(w, "time sync\t%s (offset %s)\n", s.TimeSync.Format(time.RFC3339), s.ClockOffset)
+			}
+			if !s.LastCheck.IsZero() {
+				fmt.Fprintf(w, "last check\t%s\n", s.LastCheck.Format(time.RFC3339))
+			}
+			if len(s.Drift) > 0 {
+				fmt.Fprintf(w, "drift\t%s\n", strings.Join(s.Drift, ", "))
+			}
+			if s.FailedClosed {
+				fmt.Fprintf(w, "traffic\tblocked, the session couldn't be restored\n")
+			}
+			return exitOK
+		}})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/multiversecoder/hidemego/config"
+	"github.com/multiversecoder/hidemego/linux"
+	"github.com/multiversecoder/hidemego/tools"
+	"github.com/multiversecoder/hidemego/tor"
+)
+
+func init() {
+	register(&command{
+		Name:  "stop",
+		Short: "Stop the hidemego session and revert every change",
+		Long: `
+Stops the hidemego Tor service and reverts the changes made by 'hidemego start'
+using the configuration saved when the session was started: MAC addresses,
+resolv.conf, SELinux ports, iptables rules and kernel configuration.
+
+When the hidemego daemon is running it is asked to stop the session and exit.`,
+		Examples: []string{
+			"hidemego stop"},
+		Root: true,
+		Flags: func(fs *flag.FlagSet) {
+			fs.String("socket", socketFile, "Unix socket of the daemon API")
+		},
+		Run: func(fs *flag.FlagSet) int {
+			socket := fs.Lookup("socket").Value.String()
+			if _, err := os.Stat(socket); err == nil {
+				logger.Println("Stopping the Hidemego Daemon")
+				_, err := daemonCall(socket, "stop")
+				if err == nil {
+					return exitOK
+				}
+				if _, ok := err.(*net.OpError); !ok {
+					logger.Println("Can't Stop the Hidemego Daemon:", err)
+					return exitFailure
+				}
+				// stale socket, no daemon is listening
+			}
+			once.Do(close)
+			return exitOK
+		}})
+}
+
+// Reverts the session and exits on failure, used by the commands
+func close() {
+	if err := revert(); err != nil {
+		logger.Fatal(err)
+	}
+	time.Sleep(3 * time.Second)
+	if tools.CheckConn(time.Minute) {
+		ip, err := tools.GetIPAddress()
+		if err != nil {
+			logger.Fatal("Can't Get IP Address:", err)
+		}
+		logger.Println("Your new IP is", ip)
+	}
+}
+
+// Reverts the changes of the session, stopping at the first step that
+// fails and leaves the system in a state the next steps can't fix
+func revert() error {
+	cfg, err := loadSession()
+	if err != nil {
+		return fmt.Errorf("can't load the hidemego session: %v", err)
+	}
+
+	logger.Println("Stopping Tor Service")
+	if err := tor.Stop(); err != nil {
+		return fmt.Errorf("can't stop tor: %v", err)
+	}
+	logger.Println("Removing the", tor.ServiceName, "Unit")
+	if err := tor.RemoveUnit(); err != nil {
+		logger.Println("Can't Remove the Tor Unit:", err)
+	}
+	logger.Println("Restoring resolv.conf")
+	_ = linux.RestoreResolvConf()
+
+	if ifaces := sessionIfaces(cfg); len(ifaces) > 0 {
+		for _, r := range ifaces {
+			logger.Println("Changing MAC Address for", r)
+
+			if !linux.HasIface(r) {
+				logger.Println(fmt.Sprintf("Invalid Network Interface %s Found! Skipping", r))
+				continue
+			}
+
+			if err := linux.IPSet(r, "down"); err != nil {
+				return fmt.Errorf("can't bring %s down: %v", r, err)
+			}
+			dmac, err := linux.DefaultMacAddr(r)
+			if err != nil {
+				return fmt.Errorf("can't restore the default MAC address of %s: %v", r, err)
+			}
+			logger.Println(fmt.Sprintf("Restoring %s MAC Address: %s", r, dmac))
+			if err := linux.IPSetMACAddr(r, dmac); err != nil {
+				return fmt.Errorf("can't restore the MAC address of %s: %v", r, err)
+			}
+			if err := linux.IPSet(r, "up"); err != nil {
+				return fmt.Errorf("can't bring %s up: %v", r, err)
+			}
+			time.Sleep(3 * time.Second)
+		}
+	}
+
+	logger.Println("Removing Hidemego TorRC File")
+	if err := tor.RemoveTorRc(); err != nil {
+		return fmt.Errorf("can't remove hidemego.torrc: %v", err)
+	}
+	logger.Println("Removing Hidemego Directory")
+	if err := tor.RemoveHideMeGoDir(); err != nil {
+		return fmt.Errorf("can't remove the hidemego directory: %v", err)
+	}
+	for _, p := range []struct {
+		port int
+		skip bool
+	}{
+		{cfg.Tor.SocksDestPort, cfg.Tor.SocksDestPort == 9051},
+		{cfg.Tor.SocksAuthPort, false},
+		{cfg.Tor.ControlPort, false},
+		{cfg.Tor.TransPort, false},
+	} {
+		if p.skip || !linux.HasSELPort(p.port) {
+			continue
+		}
+		logger.Println(fmt.Sprintf("Closing TCP Port on %d", p.port))
+		if err := linux.SELManage(p.port, false); err != nil {
+			return fmt.Errorf("can't close port %d: %v", p.port, err)
+		}
+	}
+	if linux.HasSELPort(cfg.Tor.DNSPort) {
+		logger.Println(fmt.Sprintf("Closing TCP and UDP Ports on %d", cfg.Tor.DNSPort))
+		_ = linux.SELManage(cfg.Tor.DNSPort, false, true)
+	}
+	for _, name := range cfg.Isolation.ClassNames() {
+		if p := cfg.Isolation.Classes[name].Port; linux.HasSELPort(p) {
+			logger.Println(fmt.Sprintf("Closing TCP Port on %d", p))
+			if err := linux.SELManage(p, false); err != nil {
+				logger.Println(fmt.Sprintf("Can't Close Port: %d ", p), err)
+			}
+		}
+	}
+
+	if cfg.Tor.UseBridges {
+		unlabelTransportPlugins(cfg)
+	}
+
+	logger.Println("Flushing IPTables Rules")
+	if err := linux.FlushIPTablesRules(); err != nil {
+		return fmt.Errorf("can't flush the iptables rules: %v", err)
+	}
+	if cfg.Gateway.Iface != "" {
+		logger.Println("Restoring Forwarding on", cfg.Gateway.Iface)
+		if err := linux.RestoreForwarding(); err != nil {
+			logger.Println("Can't Restore Forwarding:", err)
+		}
+	}
+	if cfg.Kernel.Harden {
+		logger.Println("Restoring Kernel Configuration...")
+		if err := linux.RestoreKernelConfig(); err != nil {
+			return fmt.Errorf("can't restore the kernel configuration, restart your system to revert some changes: %v", err)
+		}
+	}
+
+	logger.Println("Restarting the network using NetworkManager")
+	if err := linux.RestartNetwork(true); err != nil {
+		return fmt.Errorf("can't restart the network: %v", err)
+	}
+	logger.Println("Removing Hidemego Config Directory")
+	os.RemoveAll(confDir)
+	return nil
+}
+
+// Removes the SELinux contexts set on the pluggable transports by start
+func unlabelTransportPlugins(cfg config.Config) {
+	if ok, _ := tools.Exists("setenforce"); !ok {
+		return
+	}
+	bridges, err := cfg.BridgeLines()
+	if err != nil {
+		logger.Println("Can't Read Bridges:", err)
+		return
+	}
+	plugins, err := tor.TransportPlugins(bridges)
+	if err != nil {
+		logger.Println("Can't Find Pluggable Transports:", err)
+		return
+	}
+	for _, p := range plugins {
+		if !linux.HasSELExecContext(p.Path) {
+			continue
+		}
+		logger.Println("Removing SELinux Context for", p.Path)
+		if err := linux.SELManageExec(p.Path, false); err != nil {
+			logger.Println(fmt.Sprintf("Can't Remove SELinux Context for %s:", p.Path), err)
+		}
+	}
+}
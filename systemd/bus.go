@@ -0,0 +1,86 @@
+package systemd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ErrUnknownObject is returned when the object path doesn't exist, e.g.
+// when a job is already completed
+var ErrUnknownObject = errors.New("unknown object")
+
+// Bus is a connection to the system bus
+type Bus interface {
+	// Call invokes a method and returns its output values
+	Call(dest, path, iface, method, signature string, args ...interface{}) ([]interface{}, error)
+	// Property reads the value of a property
+	Property(dest, path, iface, name string) (interface{}, error)
+}
+
+// Busctl is the system bus accessed through busctl (systemd 240 or later)
+type Busctl struct{}
+
+// busctl --json output
+type busctlValue struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func (Busctl) run(args ...string) (busctlValue, error) {
+	var v busctlValue
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("busctl", append([]string{"--system", "--json=short"}, args...)...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if strings.Contains(msg, "Unknown object") {
+			return v, ErrUnknownObject
+		}
+		if msg == "" {
+			return v, err
+		}
+		return v, errors.New(msg)
+	}
+	if stdout.Len() == 0 {
+		return v, nil
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &v); err != nil {
+		return v, fmt.Errorf("invalid busctl output: %v", err)
+	}
+	return v, nil
+}
+
+func (b Busctl) Call(dest, path, iface, method, signature string, args ...interface{}) ([]interface{}, error) {
+	cmd := []string{"call", dest, path, iface, method}
+	if signature != "" {
+		cmd = append(cmd, signature)
+		for _, a := range args {
+			cmd = append(cmd, fmt.Sprint(a))
+		}
+	}
+	v, err := b.run(cmd...)
+	if err != nil || v.Data == nil {
+		return nil, err
+	}
+	var out []interface{}
+	if err := json.Unmarshal(v.Data, &out); err != nil {
+		return nil, fmt.Errorf("invalid busctl output: %v", err)
+	}
+	return out, nil
+}
+
+func (b Busctl) Property(dest, path, iface, name string) (interface{}, error) {
+	v, err := b.run("get-property", dest, path, iface, name)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	if err := json.Unmarshal(v.Data, &out); err != nil {
+		return nil, fmt.Errorf("invalid busctl output: %v", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,144 @@
+package systemd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// FakeBus is an in memory Bus for tests, unless Pending is set jobs complete
+// as soon as they are enqueued
+type FakeBus struct {
+	mu sync.Mutex
+	// Units maps the unit names to their ActiveState
+	Units map[string]string
+	// PIDs maps the running services to their main PID
+	PIDs map[string]int
+	// Failing units enter the failed state when started
+	Failing map[string]bool
+	// Calls are the invoked methods, e.g. "StartUnit tor@hidemego.service"
+	Calls []string
+	// Pending is the number of reads of the job State before a job
+	// completes, a negative value never completes them
+	Pending int
+	jobs    int
+	// polls counts the State reads of each job
+	polls map[string]int
+}
+
+func NewFakeBus() *FakeBus {
+	return &FakeBus{Units: map[string]string{}, PIDs: map[string]int{}, Failing: map[string]bool{}}
+}
+
+func (b *FakeBus) Call(d, path, iface, method, signature string, args ...interface{}) ([]interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	call := method
+	for _, a := range args {
+		call += " " + fmt.Sprint(a)
+	}
+	b.Calls = append(b.Calls, call)
+	if d != dest || path != objectPath || iface != managerIface {
+		return nil, ErrUnknownObject
+	}
+	if method == "Reload" {
+		return nil, nil
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s: missing unit name", method)
+	}
+	unit := fmt.Sprint(args[0])
+	switch method {
+	case "LoadUnit":
+		return []interface{}{unitObject(unit)}, nil
+	case "StartUnit", "RestartUnit", "ReloadUnit":
+		if method == "ReloadUnit" && b.Units[unit] != "active" {
+			return nil, fmt.Errorf("unit %s is not active", unit)
+		}
+		if b.Failing[unit] {
+			b.Units[unit] = "failed"
+			delete(b.PIDs, unit)
+		} else {
+			b.Units[unit] = "active"
+			if b.PIDs[unit] == 0 {
+				b.PIDs[unit] = 1000 + b.jobs
+			}
+		}
+	case "StopUnit":
+		b.Units[unit] = "inactive"
+		delete(b.PIDs, unit)
+	default:
+		return nil, fmt.Errorf("unknown method %s", method)
+	}
+	b.jobs++
+	return []interface{}{fmt.Sprintf("%s/job/%d", objectPath, b.jobs)}, nil
+}
+
+func (b *FakeBus) Property(d, path, iface, name string) (interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d == dest && strings.HasPrefix(path, objectPath+"/job/") && iface == jobIface && name == "State" {
+		if b.polls == nil {
+			b.polls = map[string]int{}
+		}
+		if b.Pending >= 0 && b.polls[path] >= b.Pending {
+			return nil, ErrUnknownObject
+		}
+		b.polls[path]++
+		return "running", nil
+	}
+	prefix := objectPath + "/unit/"
+	if d != dest || !strings.HasPrefix(path, prefix) {
+		return nil, ErrUnknownObject
+	}
+	var unit string
+	for u := range b.Units {
+		if unitObject(u) == path {
+			unit = u
+		}
+	}
+	state, loaded := b.Units[unit]
+	switch iface + "." + name {
+	case unitIface + ".LoadState":
+		if !loaded {
+			return "not-found", nil
+		}
+		return "loaded", nil
+	case unitIface + ".ActiveState":
+		if !loaded {
+			return "inactive", nil
+		}
+		return state, nil
+	case unitIface + ".SubState":
+		switch state {
+		case "active":
+			return "running", nil
+		case "failed":
+			return "failed", nil
+		}
+		return "dead", nil
+	case serviceIface + ".MainPID":
+		return float64(b.PIDs[unit]), nil
+	case serviceIface + ".Result":
+		if state == "failed" {
+			return "exit-code", nil
+		}
+		return "success", nil
+	}
+	return nil, fmt.Errorf("unknown property %s.%s", iface, name)
+}
+
+// Returns the object path of a unit, escaping the bytes that are not
+// allowed in object paths as _xx
+func unitObject(unit string) string {
+	var b strings.Builder
+	for i := 0; i < len(unit); i++ {
+		c := unit[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "_%02x", c)
+	}
+	return objectPath + "/unit/" + b.String()
+}
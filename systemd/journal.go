@@ -0,0 +1,42 @@
+package systemd
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// Returns the journal cursor of the last entry of the unit, empty when the
+// unit has no entries
+func Cursor(unit string) (string, error) {
+	out, err := exec.Command("journalctl", "--unit", unit, "--lines=1", "--output=cat",
+		"--show-cursor", "--quiet", "--no-pager").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "-- cursor: ") {
+			return strings.TrimPrefix(line, "-- cursor: "), nil
+		}
+	}
+	return "", nil
+}
+
+// Returns the messages logged by the unit after the cursor, every message
+// when the cursor is empty
+func Since(unit, cursor string) ([]string, error) {
+	args := []string{"--unit", unit, "--output=cat", "--quiet", "--no-pager"}
+	if cursor != "" {
+		args = append(args, "--after-cursor="+cursor)
+	}
+	out, err := exec.Command("journalctl", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
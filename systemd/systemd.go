@@ -0,0 +1,177 @@
+package systemd
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	dest         = "org.freedesktop.systemd1"
+	objectPath   = "/org/freedesktop/systemd1"
+	managerIface = "org.freedesktop.systemd1.Manager"
+	unitIface    = "org.freedesktop.systemd1.Unit"
+	serviceIface = "org.freedesktop.systemd1.Service"
+	jobIface     = "org.freedesktop.systemd1.Job"
+)
+
+// System is the service manager of the system bus
+var System = New(Busctl{})
+
+// Manager manages units through the org.freedesktop.systemd1 interface
+type Manager struct {
+	Bus Bus
+	// Timeout is the maximum time waited for a job to complete
+	Timeout time.Duration
+}
+
+// UnitState is the state of a unit
+type UnitState struct {
+	LoadState   string
+	ActiveState string
+	SubState    string
+}
+
+func New(bus Bus) *Manager {
+	return &Manager{Bus: bus, Timeout: 90 * time.Second}
+}
+
+func (m *Manager) Start(unit string) error {
+	return m.job("StartUnit", unit)
+}
+
+func (m *Manager) Stop(unit string) error {
+	return m.job("StopUnit", unit)
+}
+
+func (m *Manager) Restart(unit string) error {
+	return m.job("RestartUnit", unit)
+}
+
+func (m *Manager) Reload(unit string) error {
+	return m.job("ReloadUnit", unit)
+}
+
+// Reloads the unit files, like systemctl daemon-reload
+func (m *Manager) DaemonReload() error {
+	_, err := m.Bus.Call(dest, objectPath, managerIface, "Reload", "")
+	return err
+}
+
+// Reads the state of the unit
+func (m *Manager) State(unit string) (UnitState, error) {
+	var s UnitState
+	p, err := m.unitPath(unit)
+	if err != nil {
+		return s, err
+	}
+	for _, v := range []struct {
+		name string
+		dst  *string
+	}{
+		{"LoadState", &s.LoadState},
+		{"ActiveState", &s.ActiveState},
+		{"SubState", &s.SubState},
+	} {
+		if *v.dst, err = m.stringProperty(p, unitIface, v.name); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// Returns the PID of the main process of the service, zero when it is not
+// running
+func (m *Manager) MainPID(unit string) (int, error) {
+	p, err := m.unitPath(unit)
+	if err != nil {
+		return 0, err
+	}
+	v, err := m.Bus.Property(dest, p, serviceIface, "MainPID")
+	if err != nil {
+		return 0, err
+	}
+	switch pid := v.(type) {
+	case float64:
+		return int(pid), nil
+	case int:
+		return pid, nil
+	}
+	return 0, fmt.Errorf("%s: invalid MainPID %v", unit, v)
+}
+
+// Returns the object path of the unit, loading it if needed
+func (m *Manager) unitPath(unit string) (string, error) {
+	out, err := m.Bus.Call(dest, objectPath, managerIface, "LoadUnit", "s", unit)
+	if err != nil {
+		return "", err
+	}
+	if len(out) != 1 {
+		return "", fmt.Errorf("%s: unexpected LoadUnit reply %v", unit, out)
+	}
+	p, ok := out[0].(string)
+	if !ok {
+		return "", fmt.Errorf("%s: unexpected LoadUnit reply %v", unit, out)
+	}
+	return p, nil
+}
+
+func (m *Manager) stringProperty(path, iface, name string) (string, error) {
+	v, err := m.Bus.Property(dest, path, iface, name)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s: invalid %s %v", path, name, v)
+	}
+	return s, nil
+}
+
+// Enqueues a job with the given Manager method, waits for its completion and
+// checks the resulting unit state
+func (m *Manager) job(method, unit string) error {
+	out, err := m.Bus.Call(dest, objectPath, managerIface, method, "ss", unit, "replace")
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", method, unit, err)
+	}
+	if len(out) != 1 {
+		return fmt.Errorf("%s %s: unexpected reply %v", method, unit, out)
+	}
+	job, ok := out[0].(string)
+	if !ok {
+		return fmt.Errorf("%s %s: unexpected reply %v", method, unit, out)
+	}
+	// the job object is removed when the job completes
+	deadline := time.Now().Add(m.Timeout)
+	for {
+		_, err := m.Bus.Property(dest, job, jobIface, "State")
+		if err == ErrUnknownObject {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", method, unit, err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s %s: job %s not completed in %s", method, unit, job, m.Timeout)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	s, err := m.State(unit)
+	if err != nil {
+		return err
+	}
+	want := "active"
+	if method == "StopUnit" {
+		want = "inactive"
+	}
+	if s.ActiveState == want || (want == "inactive" && s.ActiveState == "failed") {
+		return nil
+	}
+	p, err := m.unitPath(unit)
+	if err == nil {
+		if result, err := m.stringProperty(p, serviceIface, "Result"); err == nil && result != "success" {
+			return fmt.Errorf("%s %s: unit is %s (%s)", method, unit, s.ActiveState, result)
+		}
+	}
+	return fmt.Errorf("%s %s: unit is %s", method, unit, s.ActiveState)
+}
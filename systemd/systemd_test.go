@@ -0,0 +1,77 @@
+package systemd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const unit = "tor@hidemego.service"
+
+func TestStartWaitsForTheJob(t *testing.T) {
+	bus := NewFakeBus()
+	bus.Pending = 2
+	m := New(bus)
+	if err := m.Start(unit); err != nil {
+		t.Fatal(err)
+	}
+	if n := bus.polls[objectPath+"/job/1"]; n != 2 {
+		t.Errorf("job State read %d times, want 2", n)
+	}
+	s, err := m.State(unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != (UnitState{LoadState: "loaded", ActiveState: "active", SubState: "running"}) {
+		t.Errorf("state after start: %+v", s)
+	}
+	pid, err := m.MainPID(unit)
+	if err != nil || pid == 0 {
+		t.Errorf("MainPID = %d, %v", pid, err)
+	}
+	if err := m.Stop(unit); err != nil {
+		t.Fatal(err)
+	}
+	if pid, _ := m.MainPID(unit); pid != 0 {
+		t.Errorf("MainPID after stop = %d", pid)
+	}
+}
+
+func TestJobTimeout(t *testing.T) {
+	bus := NewFakeBus()
+	bus.Pending = -1
+	m := New(bus)
+	m.Timeout = 300 * time.Millisecond
+	err := m.Restart(unit)
+	if err == nil || !strings.Contains(err.Error(), "not completed") {
+		t.Errorf("Restart error = %v, want a job timeout", err)
+	}
+}
+
+func TestFailedUnit(t *testing.T) {
+	bus := NewFakeBus()
+	bus.Failing[unit] = true
+	m := New(bus)
+	err := m.Start(unit)
+	if err == nil || !strings.Contains(err.Error(), "unit is failed (exit-code)") {
+		t.Errorf("Start error = %v, want the failed state and result", err)
+	}
+	// stopping a failed unit succeeds
+	if err := m.Stop(unit); err != nil {
+		t.Errorf("Stop error = %v", err)
+	}
+}
+
+func TestReloadInactiveUnit(t *testing.T) {
+	m := New(NewFakeBus())
+	if err := m.Reload(unit); err == nil {
+		t.Error("Reload of an inactive unit succeeded")
+	}
+	s, err := m.State("missing.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LoadState != "not-found" || s.ActiveState != "inactive" {
+		t.Errorf("state of a missing unit: %+v", s)
+	}
+}
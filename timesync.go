@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/multiversecoder/hidemego/config"
+	"github.com/multiversecoder/hidemego/linux"
+	"github.com/multiversecoder/hidemego/tor"
+)
+
+// clockAccuracy is the offset left alone, the Date header has a resolution
+// of one second
+const clockAccuracy = 2 * time.Second
+
+func init() {
+	register(&command{
+		Name:  "timesync",
+		Short: "Set the system clock from web servers reached through Tor",
+		Long: `
+Tor needs an accurate clock, but NTP can't go through Tor and is blocked by
+the hidemego firewall. timesync reads the Date header of the
+time_sync.sources web servers through the Tor SocksAuthPort, each one on its
+own circuit, and steps the clock by the median offset, like sdwdate.
+
+At least time_sync.min_sources must answer. The clock is left alone when the
+offset is larger than time_sync.max_step, or when the network time is outside
+the validity of the Tor consensus. The certificates are verified at the time
+of the consensus, so a wrong clock doesn't make them look expired.
+
+With time_sync.enabled (-time-sync on start) the clock is set when the
+session starts and, while the daemon runs, every time_sync.interval.`,
+		Examples: []string{
+			"hidemego timesync",
+			"hidemego timesync -dry-run",
+			"hidemego timesync -max-step=72h"},
+		Root: true,
+		Flags: func(fs *flag.FlagSet) {
+			fs.Bool("dry-run", false, "Report the clock offset without setting the clock")
+			fs.String("time-sources", "", "Web servers whose Date header is read, comma separated https URLs or http onion URLs (default: the session time_sync.sources)")
+			fs.Duration("max-step", 0, "Largest correction applied to the clock (default: the session time_sync.max_step)")
+		},
+		Run: func(fs *flag.FlagSet) int {
+			cfg, err := loadSession()
+			if err != nil {
+				logger.Println("Can't Load Hidemego Session:", err)
+				return exitFailure
+			}
+			fs.Visit(func(f *flag.Flag) {
+				if key, ok := flagKeys[f.Name]; ok && err == nil {
+					err = cfg.Set(key, f.Value.String())
+				}
+			})
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if err != nil {
+				logger.Println(err)
+				return exitUsage
+			}
+			dryRun := fs.Lookup("dry-run").Value.String() == "true"
+			if _, err := syncClock(cfg, dryRun); err != nil {
+				return exitFailure
+			}
+			return exitOK
+		}})
+}
+
+// Reads the network time through tor and steps the clock, unless dryRun,
+// when it is off by more than clockAccuracy. The outcome is logged and the
+// offset found is returned.
+func syncClock(cfg config.Config, dryRun bool) (time.Duration, error) {
+	c, err := tor.OpenControl(cfg.Tor.ControlPort, cfg.Tor.ControlPassword)
+	if err != nil {
+		logger.Println("Can't Connect to the Tor Control Port:", err)
+		return 0, err
+	}
+	defer c.Close()
+	if err := c.WaitBootstrap(3 * time.Minute); err != nil {
+		logger.Println("Can't Synchronize the Clock:", err)
+		return 0, err
+	}
+	r := tor.ClockReader{
+		SocksAddr: socksAuthAddr(cfg),
+		Timeout:   time.Minute}
+	validAfter, validUntil, err := c.ConsensusValidity()
+	if err != nil {
+		logger.Println("Can't Read the Consensus Validity:", err)
+	} else {
+		r.VerifyAt = validAfter
+	}
+	logger.Println("Reading the Time of", len(cfg.TimeSync.Sources), "Sources Through Tor")
+	var offsets []time.Duration
+	for _, s := range r.Sample(cfg.TimeSync.Sources) {
+		if s.Err != nil {
+			logger.Println("Can't Read the Time of", s.Source+":", s.Err)
+			continue
+		}
+		logger.Println(fmt.Sprintf("Clock Offset from %s: %s", s.Source, s.Offset.Round(time.Millisecond)))
+		offsets = append(offsets, s.Offset)
+	}
+	if len(offsets) < cfg.TimeSync.MinSources {
+		err := fmt.Errorf("%d of %d time sources answered, %d required", len(offsets), len(cfg.TimeSync.Sources), cfg.TimeSync.MinSources)
+		logger.Println("Can't Synchronize the Clock:", err)
+		return 0, err
+	}
+	offset := tor.MedianOffset(offsets).Round(time.Millisecond)
+	now := time.Now().Add(offset)
+	if !validAfter.IsZero() && (now.Before(validAfter.Add(-time.Hour)) || now.After(validUntil.Add(24*time.Hour))) {
+		err := fmt.Errorf("network time %s outside the consensus validity %s - %s", now.UTC().Format(time.RFC3339),
+			validAfter.Format(time.RFC3339), validUntil.Format(time.RFC3339))
+		logger.Println("Can't Synchronize the Clock:", err)
+		return offset, err
+	}
+	if offset > cfg.TimeSync.MaxStep || -offset > cfg.TimeSync.MaxStep {
+		err := fmt.Errorf("clock offset %s larger than time_sync.max_step %s", offset, cfg.TimeSync.MaxStep)
+		logger.Println("Can't Synchronize the Clock:", err)
+		return offset, err
+	}
+	if offset < clockAccuracy && -offset < clockAccuracy {
+		logger.Println("The Clock Is Accurate, Offset", offset)
+		return offset, nil
+	}
+	if dryRun {
+		logger.Println("The Clock Is Off by", offset)
+		return offset, nil
+	}
+	if err := linux.StepClock(offset); err != nil {
+		logger.Println("Can't Set the Clock:", err)
+		return offset, err
+	}
+	logger.Println("Clock Stepped by", offset)
+	return offset, nil
+}
@@ -11,7 +11,6 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"path"
 	"regexp"
 	"strings"
 	"text/template"
@@ -20,19 +19,22 @@ import (
 
 var (
 	IPRgx              = regexp.MustCompile(`[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}`)
-	aRgx               = regexp.MustCompile(`("[^"]*"|[^"\s]+)(\s+|$)`)
 	TorProjectCheckURL = "https://check.torproject.org"
-	flagsFile          = path.Join(os.Getenv("HOME"), ".config", "hidemego", "hidemego.flags")
 	//go:embed resources
 	resources embed.FS
 	templates = map[string]string{
 		"torrc":     "resources/torrc.tmpl",
-		"nymn":      "resources/nymn.tmpl",
+		"torunit":   "resources/torunit.tmpl",
 		"iptr":      "resources/iptr.tmpl",
 		"iptf":      "resources/iptf.tmpl",
+		"netns":     "resources/netns.tmpl",
+		"netnsf":    "resources/netnsf.tmpl",
 		"getifaces": "resources/getifaces.tmpl",
 		"getos":     "resources/getos.sh",
-		"sysctl":    "resources/sysctl.tmpl"}
+		"sysctl":    "resources/sysctl.tmpl",
+		"bash":      "resources/completion.bash.tmpl",
+		"zsh":       "resources/completion.zsh.tmpl",
+		"fish":      "resources/completion.fish.tmpl"}
 
 	// client for tor requests
 	client = &http.Client{
@@ -40,6 +42,9 @@ var (
 			Dial: (&net.Dialer{
 				Timeout: 60 * time.Second,
 			}).Dial,
+			// a new connection is a new tor stream, reused connections would
+			// hide identity changes
+			DisableKeepAlives: true,
 			// wait more because of tor
 			TLSHandshakeTimeout: 60 * time.Second,
 			TLSClientConfig: &tls.Config{
@@ -77,17 +82,22 @@ func TempFile(name string, content []byte) (string, error) {
 	return f.Name(), nil
 }
 
-// Wait for internet connection
-func CheckConn() bool {
+// Wait for internet connection, at most timeout
+func CheckConn(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
 	for {
 		// connect to check.toprproject.com
 		req, _ := http.NewRequest("GET", TorProjectCheckURL, nil)
-		_, err := client.Do(req)
-		if err != nil {
-			// error missing internet connection
-			continue
+		rsp, err := client.Do(req)
+		if err == nil {
+			rsp.Body.Close()
+			return true
 		}
-		return true
+		// error missing internet connection
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Second)
 	}
 }
 
@@ -156,20 +166,3 @@ func Exists(s string) (bool, error) {
 	}
 	return w != "", nil
 }
-
-func SaveFlags(args []string) error {
-	s := strings.Join(args, " ")
-	return ioutil.WriteFile(flagsFile, []byte(s), 0644)
-}
-
-func PreviousArgs() ([]string, error) {
-	if _, err := os.Stat(flagsFile); os.IsNotExist(err) {
-		return []string{}, nil
-	}
-	b, err := ioutil.ReadFile(flagsFile)
-	if err != nil {
-		return nil, err
-	}
-	return aRgx.FindAllString(string(b), -1), nil
-
-}
@@ -0,0 +1,195 @@
+package tor
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/multiversecoder/hidemego/tools"
+)
+
+var (
+	// pluggable transports and the binaries implementing them, in order of
+	// preference
+	transportPlugins = map[string][]string{
+		"obfs4":     {"lyrebird", "obfs4proxy"},
+		"meek_lite": {"lyrebird", "obfs4proxy"},
+		"webtunnel": {"lyrebird", "webtunnel-client"},
+		"snowflake": {"snowflake-client", "lyrebird"}}
+	// arguments required by each transport
+	transportArgs = map[string][]string{
+		"obfs4":     {"cert", "iat-mode"},
+		"meek_lite": {"url"},
+		"webtunnel": {"url"},
+		"snowflake": {}}
+	// directories searched for transport plugins not in PATH
+	pluginDirs = []string{
+		path.Join("/", "usr", "bin"),
+		path.Join("/", "usr", "local", "bin"),
+		path.Join("/", "usr", "libexec"),
+		path.Join("/", "usr", "libexec", "tor"),
+		path.Join("/", "usr", "lib", "tor")}
+)
+
+// Bridge is a parsed torrc bridge line:
+// [transport] IP:ORPort [fingerprint] [k=v ...]
+type Bridge struct {
+	Transport   string
+	Addr        string
+	Fingerprint string
+	Args        []string
+}
+
+// Parses and validates a bridge line, the "Bridge" prefix used in torrc
+// files and by bridges.torproject.org is accepted
+func ParseBridge(line string) (Bridge, error) {
+	var b Bridge
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "bridge") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return b, fmt.Errorf("empty bridge line")
+	}
+	if _, _, err := net.SplitHostPort(fields[0]); err != nil {
+		b.Transport = fields[0]
+		fields = fields[1:]
+		if _, ok := transportArgs[b.Transport]; !ok {
+			return b, fmt.Errorf("unsupported pluggable transport %q", b.Transport)
+		}
+	}
+	if len(fields) == 0 {
+		return b, fmt.Errorf("missing bridge address")
+	}
+	host, port, err := net.SplitHostPort(fields[0])
+	if err != nil {
+		return b, fmt.Errorf("invalid bridge address %q", fields[0])
+	}
+	if net.ParseIP(host) == nil {
+		return b, fmt.Errorf("invalid bridge address %q: must be an IP address", fields[0])
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return b, fmt.Errorf("invalid bridge port %q", port)
+	}
+	b.Addr = fields[0]
+	fields = fields[1:]
+	if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+		fp := strings.ToUpper(strings.TrimPrefix(fields[0], "$"))
+		if _, err := hex.DecodeString(fp); err != nil || len(fp) != 40 {
+			return b, fmt.Errorf("invalid bridge fingerprint %q", fields[0])
+		}
+		b.Fingerprint = fp
+		fields = fields[1:]
+	}
+	seen := map[string]bool{}
+	for _, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return b, fmt.Errorf("invalid bridge argument %q", f)
+		}
+		seen[kv[0]] = true
+		b.Args = append(b.Args, f)
+	}
+	if b.Transport == "" && len(b.Args) > 0 {
+		return b, fmt.Errorf("arguments are only allowed with a pluggable transport")
+	}
+	for _, a := range transportArgs[b.Transport] {
+		if !seen[a] {
+			return b, fmt.Errorf("%s bridge requires the %s argument", b.Transport, a)
+		}
+	}
+	return b, nil
+}
+
+// Returns the bridge line as written in the torrc
+func (b Bridge) String() string {
+	var f []string
+	if b.Transport != "" {
+		f = append(f, b.Transport)
+	}
+	f = append(f, b.Addr)
+	if b.Fingerprint != "" {
+		f = append(f, b.Fingerprint)
+	}
+	return strings.Join(append(f, b.Args...), " ")
+}
+
+// Parses the bridge lines found in the file at p, empty lines and comments
+// are skipped
+func ReadBridges(p string) ([]Bridge, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var bridges []Bridge
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		br, err := ParseBridge(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", p, i+1, err)
+		}
+		bridges = append(bridges, br)
+	}
+	return bridges, nil
+}
+
+// TransportPlugin is a ClientTransportPlugin torrc entry
+type TransportPlugin struct {
+	Transports []string
+	Path       string
+}
+
+func (p TransportPlugin) String() string {
+	return strings.Join(p.Transports, ",") + " exec " + p.Path
+}
+
+// Looks for the binary implementing the given transport
+func FindTransportPlugin(transport string) (string, error) {
+	for _, bin := range transportPlugins[transport] {
+		if p, err := tools.Which(bin); err == nil && p != "" {
+			return p, nil
+		}
+		for _, dir := range pluginDirs {
+			p := path.Join(dir, bin)
+			if fi, err := os.Stat(p); err == nil && fi.Mode()&0111 != 0 {
+				return p, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no plugin found for the %s transport, install one of: %s",
+		transport, strings.Join(transportPlugins[transport], ", "))
+}
+
+// Detects the plugins needed by the given bridges, transports implemented by
+// the same binary share one plugin
+func TransportPlugins(bridges []Bridge) ([]TransportPlugin, error) {
+	byPath := map[string][]string{}
+	seen := map[string]bool{}
+	for _, b := range bridges {
+		if b.Transport == "" || seen[b.Transport] {
+			continue
+		}
+		seen[b.Transport] = true
+		p, err := FindTransportPlugin(b.Transport)
+		if err != nil {
+			return nil, err
+		}
+		byPath[p] = append(byPath[p], b.Transport)
+	}
+	var plugins []TransportPlugin
+	for p, t := range byPath {
+		sort.Strings(t)
+		plugins = append(plugins, TransportPlugin{Transports: t, Path: p})
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Path < plugins[j].Path })
+	return plugins, nil
+}
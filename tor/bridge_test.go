@@ -0,0 +1,101 @@
+package tor
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testFingerprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+
+func TestParseBridge(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want Bridge
+		// err is a substring of the expected error, empty when valid
+		err string
+	}{
+		{line: "192.0.2.1:443",
+			want: Bridge{Addr: "192.0.2.1:443"}},
+		{line: "Bridge 192.0.2.1:443 " + testFingerprint,
+			want: Bridge{Addr: "192.0.2.1:443", Fingerprint: testFingerprint}},
+		{line: "bridge [2001:db8::1]:9001 $" + strings.ToLower(testFingerprint),
+			want: Bridge{Addr: "[2001:db8::1]:9001", Fingerprint: testFingerprint}},
+		{line: "obfs4 192.0.2.1:443 " + testFingerprint + " cert=abc iat-mode=0",
+			want: Bridge{Transport: "obfs4", Addr: "192.0.2.1:443", Fingerprint: testFingerprint, Args: []string{"cert=abc", "iat-mode=0"}}},
+		{line: "BRIDGE snowflake 192.0.2.3:80",
+			want: Bridge{Transport: "snowflake", Addr: "192.0.2.3:80"}},
+		{line: "webtunnel 192.0.2.4:443 url=https://example.com/path ver=0.0.1",
+			want: Bridge{Transport: "webtunnel", Addr: "192.0.2.4:443", Args: []string{"url=https://example.com/path", "ver=0.0.1"}}},
+		{line: "", err: "empty bridge line"},
+		{line: "Bridge", err: "empty bridge line"},
+		{line: "obfs4", err: "missing bridge address"},
+		{line: "vmess 192.0.2.1:443", err: `unsupported pluggable transport "vmess"`},
+		{line: "obfs4 192.0.2.1", err: `invalid bridge address "192.0.2.1"`},
+		{line: "bridge.example.com:443", err: `invalid bridge address "bridge.example.com:443": must be an IP address`},
+		{line: "obfs4 bridge.example.com:443 cert=abc iat-mode=0", err: "must be an IP address"},
+		{line: "192.0.2.1:0", err: `invalid bridge port "0"`},
+		{line: "192.0.2.1:https", err: `invalid bridge port "https"`},
+		{line: "192.0.2.1:443 $0123", err: `invalid bridge fingerprint "$0123"`},
+		{line: "192.0.2.1:443 " + strings.Repeat("Z", 40), err: "invalid bridge fingerprint"},
+		{line: "obfs4 192.0.2.1:443 " + testFingerprint + " cert=abc =1", err: `invalid bridge argument "=1"`},
+		{line: "192.0.2.1:443 " + testFingerprint + " cert=abc", err: "arguments are only allowed with a pluggable transport"},
+		{line: "obfs4 192.0.2.1:443 " + testFingerprint + " iat-mode=0", err: "obfs4 bridge requires the cert argument"},
+		{line: "obfs4 192.0.2.1:443 cert=abc", err: "obfs4 bridge requires the iat-mode argument"},
+		{line: "meek_lite 192.0.2.2:80 front=example.com", err: "meek_lite bridge requires the url argument"},
+	} {
+		b, err := ParseBridge(tc.line)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: error %v, want %q", tc.line, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(b, tc.want) {
+			t.Errorf("%q: parsed %+v, want %+v", tc.line, b, tc.want)
+		}
+	}
+}
+
+func TestBridgeString(t *testing.T) {
+	line := "obfs4 192.0.2.1:443 " + testFingerprint + " cert=abc iat-mode=0"
+	b, err := ParseBridge("Bridge " + line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != line {
+		t.Errorf("String() = %q, want %q", b.String(), line)
+	}
+}
+
+func TestReadBridges(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "bridges.txt")
+	data := "# bridges\n\nBridge 192.0.2.1:443\n  snowflake 192.0.2.3:80  \n"
+	if err := ioutil.WriteFile(p, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bridges, err := ReadBridges(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bridges) != 2 || bridges[0].Addr != "192.0.2.1:443" || bridges[1].Transport != "snowflake" {
+		t.Errorf("read %+v", bridges)
+	}
+	if err := ioutil.WriteFile(p, []byte(data+"obfs4 192.0.2.1:443\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadBridges(p)
+	if err == nil || !strings.Contains(err.Error(), "line 5: obfs4 bridge requires the cert argument") {
+		t.Errorf("error %v, want the line of the invalid bridge", err)
+	}
+	if _, err := ReadBridges(filepath.Join(dir, "missing")); err == nil {
+		t.Error("reading a missing file succeeded")
+	}
+}
@@ -0,0 +1,239 @@
+package tor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Relay is a tor relay as listed in a circuit path
+type Relay struct {
+	Fingerprint string `json:"fingerprint"`
+	Nickname    string `json:"nickname"`
+	// Addr and Country are filled by Control.Locate
+	Addr    string `json:"addr,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// Circuit is a circuit as reported by GETINFO circuit-status
+type Circuit struct {
+	ID     string
+	Status string
+	Path   []Relay
+	// Flags are the BUILD_FLAGS of the circuit
+	Flags   []string
+	Purpose string
+}
+
+// Stream is a stream as reported by GETINFO stream-status
+type Stream struct {
+	ID        string
+	Status    string
+	CircuitID string
+	Target    string
+}
+
+// Parses a circuit-status line:
+// ID STATUS [$FP~nick,...] [BUILD_FLAGS=...] [PURPOSE=...] ...
+func ParseCircuit(line string) (Circuit, error) {
+	var c Circuit
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return c, fmt.Errorf("invalid circuit %q", line)
+	}
+	c.ID, c.Status = f[0], f[1]
+	for _, kv := range f[2:] {
+		switch {
+		case strings.HasPrefix(kv, "$"):
+			for _, r := range strings.Split(kv, ",") {
+				// $FP~nick, $FP=nick or $FP
+				fp := strings.TrimPrefix(r, "$")
+				var nick string
+				if i := strings.IndexAny(fp, "~="); i >= 0 {
+					fp, nick = fp[:i], fp[i+1:]
+				}
+				c.Path = append(c.Path, Relay{Fingerprint: fp, Nickname: nick})
+			}
+		case strings.HasPrefix(kv, "BUILD_FLAGS="):
+			c.Flags = strings.Split(strings.TrimPrefix(kv, "BUILD_FLAGS="), ",")
+		case strings.HasPrefix(kv, "PURPOSE="):
+			c.Purpose = strings.TrimPrefix(kv, "PURPOSE=")
+		}
+	}
+	return c, nil
+}
+
+// Returns the last relay of the circuit
+func (c Circuit) Exit() (Relay, bool) {
+	if len(c.Path) == 0 {
+		return Relay{}, false
+	}
+	return c.Path[len(c.Path)-1], true
+}
+
+// Reports whether the circuit carries user traffic to an exit
+func (c Circuit) General() bool {
+	if c.Status != "BUILT" || c.Purpose != "GENERAL" {
+		return false
+	}
+	for _, f := range c.Flags {
+		if f == "IS_INTERNAL" || f == "ONEHOP_TUNNEL" {
+			return false
+		}
+	}
+	return true
+}
+
+// Lists the open circuits
+func (c *Control) Circuits() ([]Circuit, error) {
+	info, err := c.GetInfo("circuit-status")
+	if err != nil {
+		return nil, err
+	}
+	var circuits []Circuit
+	for _, line := range strings.Split(info["circuit-status"], "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		ci, err := ParseCircuit(line)
+		if err != nil {
+			return nil, err
+		}
+		circuits = append(circuits, ci)
+	}
+	return circuits, nil
+}
+
+// Lists the open streams
+func (c *Control) Streams() ([]Stream, error) {
+	info, err := c.GetInfo("stream-status")
+	if err != nil {
+		return nil, err
+	}
+	var streams []Stream
+	for _, line := range strings.Split(info["stream-status"], "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 {
+			continue
+		}
+		streams = append(streams, Stream{ID: f[0], Status: f[1], CircuitID: f[2], Target: f[3]})
+	}
+	return streams, nil
+}
+
+func (c *Control) CloseCircuit(id string) error {
+	_, err := c.Command("CLOSECIRCUIT %s", id)
+	return err
+}
+
+func (c *Control) CloseStream(id string) error {
+	// reason 1 is REASON_MISC
+	_, err := c.Command("CLOSESTREAM %s 1", id)
+	return err
+}
+
+// Fills the address and the country of the relay using the consensus and
+// the tor GeoIP database
+func (c *Control) Locate(r *Relay) error {
+	key := "ns/id/" + r.Fingerprint
+	info, err := c.GetInfo(key)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(info[key], "\n") {
+		// r nickname identity digest date time IP ORPort DirPort
+		if f := strings.Fields(line); len(f) >= 7 && f[0] == "r" {
+			r.Addr = f[6]
+			break
+		}
+	}
+	if r.Addr == "" {
+		return fmt.Errorf("relay %s not found in the consensus", r.Fingerprint)
+	}
+	key = "ip-to-country/" + r.Addr
+	info, err = c.GetInfo(key)
+	if err != nil {
+		return err
+	}
+	r.Country = info[key]
+	return nil
+}
+
+// Sets ExcludeExitNodes to the nodes of the node policy, e.g. {us},{gb},
+// and the exit fingerprints, so that tor never builds circuits through them.
+// The setting lasts until tor reloads its torrc.
+func (c *Control) ExcludeExits(nodes string, fingerprints []string) error {
+	list := []string{}
+	if nodes != "" {
+		list = append(list, nodes)
+	}
+	for _, fp := range fingerprints {
+		list = append(list, "$"+strings.ToUpper(strings.TrimPrefix(fp, "$")))
+	}
+	if len(list) == 0 {
+		_, err := c.Command("RESETCONF ExcludeExitNodes")
+		return err
+	}
+	_, err := c.Command("SETCONF ExcludeExitNodes=\"%s\"", strings.Join(list, ","))
+	return err
+}
+
+// Changes identity and waits for a new general circuit whose exit differs
+// from the exits in use and from the excluded fingerprints. NEWNYM only
+// marks the open circuits as dirty, so the general ones are closed with
+// their streams, the onion service and internal circuits are kept.
+func NewExit(c *Control, exclude []string, timeout time.Duration) (Relay, error) {
+	old, err := c.Circuits()
+	if err != nil {
+		return Relay{}, err
+	}
+	if err := c.NewNym(); err != nil {
+		return Relay{}, err
+	}
+	skip := map[string]bool{}
+	for _, fp := range exclude {
+		skip[strings.ToUpper(fp)] = true
+	}
+	closed := map[string]bool{}
+	for _, ci := range old {
+		if e, ok := ci.Exit(); ok && ci.General() {
+			skip[e.Fingerprint] = true
+			closed[ci.ID] = true
+		}
+	}
+	streams, err := c.Streams()
+	if err != nil {
+		return Relay{}, err
+	}
+	for _, s := range streams {
+		if closed[s.CircuitID] {
+			// the stream may be already gone
+			c.CloseStream(s.ID)
+		}
+	}
+	for id := range closed {
+		c.CloseCircuit(id)
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		circuits, err := c.Circuits()
+		if err != nil {
+			return Relay{}, err
+		}
+		for _, ci := range circuits {
+			e, ok := ci.Exit()
+			if !ok || !ci.General() || closed[ci.ID] {
+				continue
+			}
+			if skip[e.Fingerprint] {
+				// force tor to build another circuit
+				c.CloseCircuit(ci.ID)
+				closed[ci.ID] = true
+				continue
+			}
+			return e, nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return Relay{}, fmt.Errorf("no circuit with a new exit built in %s", timeout)
+}
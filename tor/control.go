@@ -0,0 +1,297 @@
+package tor
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/multiversecoder/hidemego/tools"
+)
+
+var (
+	// CookieFile is the control port authentication cookie written by tor
+	CookieFile = path.Join(HidemegoLib, "control_auth_cookie")
+	// NewnymInterval is the minimum interval tor accepts between two NEWNYM
+	// signals, faster requests are delayed by tor
+	NewnymInterval = 10 * time.Second
+)
+
+// Control is a connection to the tor control port
+type Control struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// time of the last NEWNYM sent on this connection
+	newnym time.Time
+}
+
+// Reply is a control port reply
+type Reply struct {
+	Status int
+	// Lines are the reply lines without the status code
+	Lines []string
+}
+
+// Connects to the tor control port listening on 127.0.0.1
+func DialControl(port int) (*Control, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Control{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Connects and authenticates to the control port using the password, or
+// the authentication cookie when no password is given
+func OpenControl(port int, password string) (*Control, error) {
+	c, err := DialControl(port)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Authenticate(password); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Control) Close() error {
+	c.conn.Write([]byte("QUIT\r\n"))
+	return c.conn.Close()
+}
+
+// Sends a command and reads its reply, replies with a status code other
+// than 2xx are returned as errors
+func (c *Control) Command(format string, args ...interface{}) (Reply, error) {
+	var r Reply
+	c.conn.SetDeadline(time.Now().Add(60 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := fmt.Fprintf(c.conn, format+"\r\n", args...); err != nil {
+		return r, err
+	}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return r, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return r, fmt.Errorf("invalid control reply %q", line)
+		}
+		r.Status, err = strconv.Atoi(line[:3])
+		if err != nil {
+			return r, fmt.Errorf("invalid control reply %q", line)
+		}
+		switch line[3] {
+		case ' ':
+			r.Lines = append(r.Lines, line[4:])
+			if r.Status/100 != 2 {
+				return r, fmt.Errorf("tor control: %d %s", r.Status, line[4:])
+			}
+			return r, nil
+		case '-':
+			r.Lines = append(r.Lines, line[4:])
+		case '+':
+			// data reply terminated by a single dot
+			data, err := textproto.NewReader(c.r).ReadDotLines()
+			if err != nil {
+				return r, err
+			}
+			r.Lines = append(r.Lines, line[4:]+"\n"+strings.Join(data, "\n"))
+		default:
+			return r, fmt.Errorf("invalid control reply %q", line)
+		}
+	}
+}
+
+// Authenticates with the password or, when it is empty, with the cookie
+// file advertised by PROTOCOLINFO
+func (c *Control) Authenticate(password string) error {
+	if password != "" {
+		_, err := c.Command("AUTHENTICATE %s", strconv.Quote(password))
+		return err
+	}
+	r, err := c.Command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	cookie := CookieFile
+	for _, line := range r.Lines {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		if strings.Contains(line, "METHODS=NULL") {
+			_, err := c.Command("AUTHENTICATE")
+			return err
+		}
+		if i := strings.Index(line, "COOKIEFILE="); i >= 0 {
+			if f, err := strconv.Unquote(line[i+len("COOKIEFILE="):]); err == nil {
+				cookie = f
+			}
+		}
+	}
+	b, err := ioutil.ReadFile(cookie)
+	if err != nil {
+		return fmt.Errorf("can't read the control cookie: %v", err)
+	}
+	_, err = c.Command("AUTHENTICATE %s", hex.EncodeToString(b))
+	return err
+}
+
+// Waits until tor reports a complete bootstrap or timeout expires
+func (c *Control) WaitBootstrap(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := c.GetInfo("status/bootstrap-phase")
+		if err != nil {
+			return err
+		}
+		phase := info["status/bootstrap-phase"]
+		if strings.Contains(phase, "PROGRESS=100 ") {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tor not bootstrapped in %s: %s", timeout, phase)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Sends a signal such as NEWNYM, RELOAD or HUP
+func (c *Control) Signal(sig string) error {
+	_, err := c.Command("SIGNAL %s", sig)
+	return err
+}
+
+// Sends NEWNYM, waiting NewnymInterval since the previous NEWNYM so that
+// tor doesn't delay the signal
+func (c *Control) NewNym() error {
+	if wait := NewnymInterval - time.Since(c.newnym); wait > 0 {
+		time.Sleep(wait)
+	}
+	if err := c.Signal("NEWNYM"); err != nil {
+		return err
+	}
+	c.newnym = time.Now()
+	return nil
+}
+
+// Sends NEWNYM until the exit IP address read through the SocksPort at socks
+// differs from ip, at most attempts times. The last IP address is returned
+// with an error when it never changed.
+func RotateIdentity(c *Control, socks, ip string, attempts int) (string, error) {
+	nip := ip
+	for i := 0; i < attempts; i++ {
+		if err := c.NewNym(); err != nil {
+			return nip, err
+		}
+		var err error
+		nip, err = ExitIP(socks, time.Minute)
+		if err != nil {
+			return nip, err
+		}
+		if nip != ip {
+			return nip, nil
+		}
+	}
+	return nip, fmt.Errorf("exit IP address %s unchanged after %d attempts", ip, attempts)
+}
+
+// Returns the exit IP address of the streams of the tor SocksPort at socks.
+// The address is read through tor, a direct request sees the address of the
+// host when only some applications are torified.
+func ExitIP(socks string, timeout time.Duration) (string, error) {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return DialSOCKS(socks, "hidemego-exit-ip", "x", addr, timeout)
+			},
+			// a new connection is a new tor stream, reused connections would
+			// hide identity changes
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{MinVersion: tls.VersionTLS12}}}
+	rsp, err := client.Get(tools.TorProjectCheckURL)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", tools.TorProjectCheckURL, rsp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	ip := tools.IPRgx.Find(b)
+	if ip == nil {
+		return "", fmt.Errorf("%s: no IP address in the page", tools.TorProjectCheckURL)
+	}
+	return string(ip), nil
+}
+
+// Reads the values of the given GETINFO keys
+func (c *Control) GetInfo(keys ...string) (map[string]string, error) {
+	r, err := c.Command("GETINFO %s", strings.Join(keys, " "))
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]string{}
+	for _, line := range r.Lines {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		info[kv[0]] = strings.TrimPrefix(kv[1], "\n")
+	}
+	return info, nil
+}
+
+// s2kCount is the specifier of the iteration count used by tor, 65536 bytes
+const s2kCount = 96
+
+// Hashes a control password as expected by HashedControlPassword, already
+// hashed passwords are returned unchanged. The hash is computed like
+// 'tor --hash-password', which would expose the password in its command line.
+func HashControlPassword(password string) (string, error) {
+	if strings.HasPrefix(password, "16:") {
+		return password, nil
+	}
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := secretToKey(salt, s2kCount, []byte(password))
+	return "16:" + strings.ToUpper(hex.EncodeToString(append(append(salt, s2kCount), key[:]...))), nil
+}
+
+// Derives a key with the RFC 2440 iterated and salted S2K: the salt and the
+// secret are hashed repeatedly until the count of bytes encoded by c
+func secretToKey(salt []byte, c byte, secret []byte) [sha1.Size]byte {
+	count := (16 + int(c&15)) << (uint(c>>4) + 6)
+	block := append(append([]byte(nil), salt...), secret...)
+	h := sha1.New()
+	for count > 0 {
+		n := len(block)
+		if count < n {
+			n = count
+		}
+		h.Write(block[:n])
+		count -= n
+	}
+	var key [sha1.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
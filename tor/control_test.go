@@ -0,0 +1,80 @@
+package tor
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/multiversecoder/hidemego/tools"
+)
+
+// The vectors of the tor test suite, test_crypto_s2k_rfc2440
+func TestSecretToKey(t *testing.T) {
+	// count 1024 of an empty secret and salt: 1024 zero bytes
+	key := secretToKey(make([]byte, 8), 0, nil)
+	if want := sha1.Sum(make([]byte, 1024)); key != want {
+		t.Errorf("empty secret: %x, want %x", key, want)
+	}
+	// count 65536 of the salt and the secret repeated
+	key = secretToKey([]byte("vrbelvbe"), 96, []byte("12345678"))
+	if want := sha1.Sum(bytes.Repeat([]byte("vrbelvbe12345678"), 65536/16)); key != want {
+		t.Errorf("vrbelvbe12345678: %x, want %x", key, want)
+	}
+	// a block longer than the count is truncated
+	secret := bytes.Repeat([]byte("x"), 2000)
+	key = secretToKey(make([]byte, 8), 0, secret)
+	if want := sha1.Sum(append(make([]byte, 8), secret[:1016]...)); key != want {
+		t.Errorf("truncated block: %x, want %x", key, want)
+	}
+}
+
+func TestHashControlPassword(t *testing.T) {
+	hash, err := HashControlPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^16:[0-9A-F]{16}60[0-9A-F]{40}$`).MatchString(hash) {
+		t.Fatalf("hash %q not in the HashedControlPassword format", hash)
+	}
+	b, _ := hex.DecodeString(hash[3:])
+	if key := secretToKey(b[:8], b[8], []byte("secret")); !bytes.Equal(key[:], b[9:]) {
+		t.Errorf("hash %q doesn't match the password", hash)
+	}
+	other, _ := HashControlPassword("secret")
+	if other == hash {
+		t.Error("two hashes share the salt")
+	}
+	if h, _ := HashControlPassword(hash); h != hash {
+		t.Errorf("hashed password changed to %q", h)
+	}
+	if strings.Contains(hash, "secret") {
+		t.Error("the hash contains the password")
+	}
+}
+
+func TestExitIP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<p>Your IP address appears to be: <strong>203.0.113.7</strong></p>")
+	}))
+	defer srv.Close()
+	defer func(u string) { tools.TorProjectCheckURL = u }(tools.TorProjectCheckURL)
+	tools.TorProjectCheckURL = "http://check.example.com/"
+	socks, users, targets := fakeSocks(t, func(string) string { return srv.Listener.Addr().String() })
+	ip, err := ExitIP(socks, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "203.0.113.7" {
+		t.Errorf("exit IP %q, want 203.0.113.7", ip)
+	}
+	if u, target := <-users, <-targets; u != "hidemego-exit-ip" || target != "check.example.com:80" {
+		t.Errorf("request of %q to %s, want the exit IP credentials to check.example.com:80", u, target)
+	}
+}
@@ -1,20 +1,184 @@
 package tor
 
-import "strings"
+import (
+	_ "embed"
+	"fmt"
+	"sort"
+	"strings"
+)
 
-var Eyes5C []string = []string{
-	"{US}", "{GB}", "{AU}", "{CA}", "{NZ}"}
+// Country is an ISO 3166-1 country as used by the tor GeoIP database
+type Country struct {
+	Code string
+	Name string
+}
+
+var (
+	//go:embed iso3166.txt
+	iso3166   string
+	countries = map[string]string{}
+
+	// Groups are the built-in country groups, referenced as @name
+	Groups = map[string][]string{
+		"5eyes":   {"us", "gb", "au", "ca", "nz"},
+		"9eyes":   {"us", "gb", "au", "ca", "nz", "fr", "dk", "nl", "no"},
+		"14eyes":  {"us", "gb", "au", "ca", "nz", "fr", "dk", "nl", "no", "de", "be", "it", "es", "se"},
+		"14eyes+": {"us", "gb", "au", "ca", "nz", "fr", "dk", "nl", "no", "de", "be", "it", "es", "se", "il", "jp", "kr", "kp", "sg", "cn"}}
+)
+
+func init() {
+	for _, line := range strings.Split(iso3166, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.SplitN(line, "\t", 2)
+		countries[f[0]] = f[1]
+	}
+}
+
+// Lists the countries of the embedded ISO 3166-1 table
+func Countries() []Country {
+	list := make([]Country, 0, len(countries))
+	for code, name := range countries {
+		list = append(list, Country{Code: code, Name: name})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return list
+}
+
+// Returns the name of the country with the given ISO 3166-1 alpha-2 code
+func CountryName(code string) (string, bool) {
+	name, ok := countries[strings.ToLower(code)]
+	return name, ok
+}
+
+// Expands a list of ISO 3166-1 alpha-2 codes and @group references into
+// a sorted list of unique lower case country codes. User defined groups
+// may reference other groups and replace the built-in ones.
+func ExpandCountries(list []string, groups map[string][]string) ([]string, error) {
+	seen := map[string]bool{}
+	var codes []string
+	var expand func(list []string, path []string) error
+	expand = func(list []string, path []string) error {
+		for _, e := range list {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if !strings.HasPrefix(e, "@") {
+				if _, ok := countries[e]; !ok {
+					return fmt.Errorf("unknown country code %q", e)
+				}
+				if !seen[e] {
+					seen[e] = true
+					codes = append(codes, e)
+				}
+				continue
+			}
+			name := e[1:]
+			for _, p := range path {
+				if p == name {
+					return fmt.Errorf("country group @%s is part of a reference cycle", name)
+				}
+			}
+			members, ok := groups[name]
+			if !ok {
+				members, ok = Groups[name]
+			}
+			if !ok {
+				return fmt.Errorf("unknown country group %s", e)
+			}
+			if err := expand(members, append(path, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := expand(list, nil); err != nil {
+		return nil, err
+	}
+	sort.Strings(codes)
+	return codes, nil
+}
+
+// NodePolicy selects the relays tor may use by country. Every list accepts
+// ISO 3166-1 alpha-2 codes and @group references.
+type NodePolicy struct {
+	// Exclude are never used in any position of a circuit
+	Exclude []string
+	// ExcludeExit are never used as exit
+	ExcludeExit []string
+	// Entry, when not empty, are the only countries used as guard
+	Entry []string
+	// Exit, when not empty, are the only countries used as exit
+	Exit []string
+	// Groups are the user defined country groups
+	Groups map[string][]string
+}
 
-var Eyes9C []string = []string{
-	"{US}", "{GB}", "{AU}", "{CA}", "{NZ}", "{FR}", "{GB}", "{AU}", "{CA}", "{NZ}"}
+// NodeSelection is the expanded node policy rendered in the torrc
+type NodeSelection struct {
+	ExcludeNodes     string
+	ExcludeExitNodes string
+	EntryNodes       string
+	ExitNodes        string
+}
 
-var Eyes14C []string = []string{
-	"{US}", "{GB}", "{AU}", "{CA}", "{NZ}", "{FR}", "{GB}", "{AU}", "{CA}", "{NZ}", "{BE}", "{IT}", "{ES}", "{DE}", "{SE}"}
+// Expands and checks the policy
+func (p NodePolicy) Selection() (NodeSelection, error) {
+	var s NodeSelection
+	exclude, err := ExpandCountries(p.Exclude, p.Groups)
+	if err != nil {
+		return s, fmt.Errorf("exclude: %v", err)
+	}
+	excludeExit, err := ExpandCountries(p.ExcludeExit, p.Groups)
+	if err != nil {
+		return s, fmt.Errorf("exclude exit: %v", err)
+	}
+	entry, err := ExpandCountries(p.Entry, p.Groups)
+	if err != nil {
+		return s, fmt.Errorf("entry: %v", err)
+	}
+	exit, err := ExpandCountries(p.Exit, p.Groups)
+	if err != nil {
+		return s, fmt.Errorf("exit: %v", err)
+	}
+	if len(entry) > 0 && len(subtract(entry, exclude)) == 0 {
+		return s, fmt.Errorf("every entry country is excluded")
+	}
+	if len(exit) > 0 && len(subtract(subtract(exit, exclude), excludeExit)) == 0 {
+		return s, fmt.Errorf("every exit country is excluded")
+	}
+	s.ExcludeNodes = torCountries(exclude)
+	s.ExcludeExitNodes = torCountries(excludeExit)
+	s.EntryNodes = torCountries(entry)
+	s.ExitNodes = torCountries(exit)
+	return s, nil
+}
 
-var Eyes14CPlus []string = []string{
-	"{US}", "{GB}", "{AU}", "{CA}", "{NZ}", "{FR}", "{GB}", "{AU}", "{CA}", "{NZ}", "{BE}", "{IT}", "{ES}", "{DE}", "{SE}", "{KP}", "{IL}", "{CN}", "{KR}", "{IL}", "{SG}"}
+// Returns the codes in a that are not in b
+func subtract(a, b []string) []string {
+	var r []string
+	for _, c := range a {
+		found := false
+		for _, d := range b {
+			if c == d {
+				found = true
+				break
+			}
+		}
+		if !found {
+			r = append(r, c)
+		}
+	}
+	return r
+}
 
-const Countries string = "{AF},{AX},{AL},{DZ},{AD},{AO},{AI},{AQ},{AG},{AR},{AM},{AW},{AU},{AT},{AZ},{BS},{BH},{BD},{BB},{BY},{BE},{BZ},{BJ},{BM},{BT},{BO},{BA},{BW},{BV},{BR},{IO},{VG},{BN},{BG},{BF},{BI},{KH},{CM}, {CA},{CV},{KY},{CF},{TD},{CL},{CN},{CX},{CC},{CO},{KM},{CG},{CD},{CK},{CR},{CI},{HR},{CU},{CY},{CZ},{DK},{DJ},{DM},{DO},{EC},{EG},{SV},{GQ},{EE},{ET},{FK},{FO},{FJ},{FI},{FR},{GF},{PF},{TF},{GA},{GM},{GE},{DE},{GH},{GI},{GR},{GL},{GD},{GP},{GU},{GT},{GN},{GW},{GY},{HT},{HM},{HN},{HK},{HU},{IS},{IN},{ID},{IR},{IQ},{IE},{IM},{IL},{IT},{JM},{JP},{JO},{KZ},{KE},{KI},{KP},{KR},{KW},{KG},{LA},{LV},{LB},{LS},{LR},{LY},{LI},{LT},{LU},{MO},{MK},{MG},{MW},{MY},{MV},{ML},{MT},{MH},{MQ},{MR},{MU},{YT},{MX},{FM},{MD},{MC},{MN},{ME},{MS},{MA},{MZ},{MM},{NA},{NR},{NP},{NL},{NC},{NZ},{NI},{NE},{NG},{NU},{NF},{MP},{NO},{OM},{PK},{PW},{PS},{PA},{PG},{PY},{PE},{PH},{PN},{PL},{PT},{PR},{QA},{RE},{RO},{RU},{RW},{WS},{SM},{ST},{SA},{SN},{RS},{SC},{SL},{SG},{SK},{SI},{SB},{SO},{AS},{ZA},{GS},{ES},{LK},{SH},{KN},{LC},{PM},{VC},{SD},{SR},{SJ},{SZ},{SE},{CH},{SY},{TW},{TJ},{TZ},{TH},{TG},{TK},{TO},{TT},{TN},{TR},{TM},{TC},{TV},{UG},{UA},{AE},{GB},{US},{UM},{UY},{UZ},{VU},{VA},{VE},{VN},{VI},{WF},{EH},{YE},{ZM},{ZW}"
+// Formats country codes as a torrc node list, e.g. {us},{gb}
+func torCountries(codes []string) string {
+	list := make([]string, len(codes))
+	for i, c := range codes {
+		list[i] = "{" + c + "}"
+	}
+	return strings.Join(list, ",")
+}
 
 var excludedTorAddress []string = []string{
 	"0.0.0.0/8",
@@ -37,11 +201,3 @@ var excludedTorAddress []string = []string{
 func NonTor() string {
 	return strings.Join(excludedTorAddress, " ")
 }
-
-func NoEyes(list []string) string {
-	var c = Countries
-	for _, r := range list {
-		c = strings.Replace(c, r+",", "", 1)
-	}
-	return c
-}
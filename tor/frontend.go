@@ -0,0 +1,323 @@
+package tor
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FrontEndTimeout bounds the handshake of a client and the connection to
+// the destination through tor
+var FrontEndTimeout = 2 * time.Minute
+
+// FrontEnd relays the streams of its SOCKS5 and HTTP CONNECT clients to a
+// tor SocksPort. The credentials of a client are passed on to tor, so that
+// every user:password pair gets its own circuits (IsolateSOCKSAuth) even
+// when the client only speaks HTTP.
+type FrontEnd struct {
+	// SocksAddr is the address of the tor SocksPort
+	SocksAddr string
+	// Log reports the refused clients and the failed streams, nil discards
+	Log func(v ...interface{})
+	mu  sync.RWMutex
+	// users are the accepted credentials, any are accepted when empty
+	users map[string]string
+}
+
+// Replaces the accepted credentials, nil accepts any credentials and the
+// clients without them
+func (f *FrontEnd) SetUsers(users map[string]string) {
+	f.mu.Lock()
+	f.users = users
+	f.mu.Unlock()
+}
+
+// Checks the credentials of a client, an empty user means no credentials
+func (f *FrontEnd) allowed(user, pass string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if len(f.users) == 0 {
+		return true
+	}
+	p, ok := f.users[user]
+	return ok && user != "" && p == pass
+}
+
+// Returns true when the front-end requires credentials
+func (f *FrontEnd) restricted() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.users) > 0
+}
+
+func (f *FrontEnd) logf(format string, args ...interface{}) {
+	if f.Log != nil {
+		f.Log(fmt.Sprintf(format, args...))
+	}
+}
+
+// Accepts the SOCKS5 clients of l until it is closed
+func (f *FrontEnd) ServeSOCKS(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go f.handleSOCKS(c)
+	}
+}
+
+func (f *FrontEnd) handleSOCKS(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(FrontEndTimeout))
+	user, pass, err := f.socksAuth(c)
+	if err != nil {
+		f.logf("SOCKS client %s: %v", c.RemoteAddr(), err)
+		return
+	}
+	// VER CMD RSV ATYP
+	var h [4]byte
+	if _, err := io.ReadFull(c, h[:]); err != nil || h[0] != 5 {
+		return
+	}
+	if h[1] != 1 {
+		// only CONNECT is supported
+		socksReply(c, 7)
+		return
+	}
+	var host string
+	switch h[3] {
+	case 1, 4:
+		ip := make(net.IP, net.IPv4len)
+		if h[3] == 4 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case 3:
+		var l [1]byte
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			return
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		socksReply(c, 8)
+		return
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	t, err := DialSOCKS(f.SocksAddr, user, pass, target, FrontEndTimeout)
+	if err != nil {
+		f.logf("SOCKS stream to %s: %v", target, err)
+		var se SocksError
+		if errors.As(err, &se) {
+			socksReply(c, se.Code)
+		} else {
+			socksReply(c, 1)
+		}
+		return
+	}
+	defer t.Close()
+	if err := socksReply(c, 0); err != nil {
+		return
+	}
+	c.SetDeadline(time.Time{})
+	relay(c, t)
+}
+
+// Negotiates the authentication method with a SOCKS5 client and returns
+// its credentials, empty when it authenticated with no method
+func (f *FrontEnd) socksAuth(c net.Conn) (string, string, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(c, h[:]); err != nil {
+		return "", "", err
+	}
+	if h[0] != 5 {
+		return "", "", fmt.Errorf("unsupported SOCKS version %d", h[0])
+	}
+	methods := make([]byte, h[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", "", err
+	}
+	method := byte(0xff)
+	for _, m := range methods {
+		// prefer the credentials, they select the circuits
+		if m == 2 || (m == 0 && method != 2 && !f.restricted()) {
+			method = m
+		}
+	}
+	if _, err := c.Write([]byte{5, method}); err != nil {
+		return "", "", err
+	}
+	switch method {
+	case 0:
+		return "", "", nil
+	case 0xff:
+		return "", "", fmt.Errorf("no acceptable authentication method")
+	}
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(c, h[:]); err != nil || h[0] != 1 {
+		return "", "", fmt.Errorf("invalid authentication request")
+	}
+	user := make([]byte, h[1])
+	if _, err := io.ReadFull(c, user); err != nil {
+		return "", "", err
+	}
+	if _, err := io.ReadFull(c, h[:1]); err != nil {
+		return "", "", err
+	}
+	pass := make([]byte, h[0])
+	if _, err := io.ReadFull(c, pass); err != nil {
+		return "", "", err
+	}
+	if !f.allowed(string(user), string(pass)) {
+		c.Write([]byte{1, 1})
+		return "", "", fmt.Errorf("invalid credentials for user %q", user)
+	}
+	_, err := c.Write([]byte{1, 0})
+	return string(user), string(pass), err
+}
+
+// Sends a SOCKS5 reply with an empty bound address
+func socksReply(c net.Conn, code byte) error {
+	_, err := c.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// Accepts the HTTP CONNECT clients of l until it is closed, the other
+// methods are refused
+func (f *FrontEnd) ServeConnect(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go f.handleHTTP(c)
+	}
+}
+
+func (f *FrontEnd) handleHTTP(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(FrontEndTimeout))
+	r := bufio.NewReader(c)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect {
+		httpReply(c, http.StatusMethodNotAllowed, "Allow: CONNECT\r\n")
+		return
+	}
+	user, pass, ok := proxyAuth(req.Header.Get("Proxy-Authorization"))
+	if !ok || !f.allowed(user, pass) {
+		if ok && user != "" {
+			f.logf("HTTP client %s: invalid credentials for user %q", c.RemoteAddr(), user)
+		}
+		httpReply(c, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"hidemego\"\r\n")
+		return
+	}
+	target := req.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		httpReply(c, http.StatusBadRequest, "")
+		return
+	}
+	t, err := DialSOCKS(f.SocksAddr, user, pass, target, FrontEndTimeout)
+	if err != nil {
+		f.logf("HTTP stream to %s: %v", target, err)
+		var se SocksError
+		if errors.As(err, &se) && se.Code == 6 {
+			httpReply(c, http.StatusGatewayTimeout, "")
+		} else {
+			httpReply(c, http.StatusBadGateway, "")
+		}
+		return
+	}
+	defer t.Close()
+	if err := httpReply(c, http.StatusOK, ""); err != nil {
+		return
+	}
+	c.SetDeadline(time.Time{})
+	// the client may have sent the first bytes of the stream already
+	if n := r.Buffered(); n > 0 {
+		b, _ := r.Peek(n)
+		if _, err := t.Write(b); err != nil {
+			return
+		}
+	}
+	relay(c, t)
+}
+
+// Returns the credentials of a Proxy-Authorization header, a missing
+// header is valid and returns no credentials
+func proxyAuth(h string) (string, string, bool) {
+	if h == "" {
+		return "", "", true
+	}
+	const prefix = "basic "
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(h[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	kv := strings.SplitN(string(b), ":", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return "", "", false
+	}
+	return kv[0], kv[1], true
+}
+
+// Sends a reply without body, a successful CONNECT reply has no
+// Content-Length since the stream follows it
+func httpReply(c net.Conn, status int, headers string) error {
+	if status != http.StatusOK {
+		headers += "Content-Length: 0\r\n"
+	}
+	_, err := fmt.Fprintf(c, "HTTP/1.1 %d %s\r\n%s\r\n", status, http.StatusText(status), headers)
+	return err
+}
+
+// Copies the data in both directions until both sides are done
+func relay(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(b, a)
+		closeWrite(b)
+		close(done)
+	}()
+	io.Copy(a, b)
+	closeWrite(a)
+	<-done
+}
+
+func closeWrite(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+}
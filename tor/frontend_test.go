@@ -0,0 +1,233 @@
+package tor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts a server echoing the data of its clients
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// Returns a front-end accepting alice:secret whose streams reach the echo
+// server through a fake tor SocksPort
+func testFrontEnd(t *testing.T) (*FrontEnd, chan string, chan string) {
+	echo := echoServer(t)
+	socks, users, targets := fakeSocks(t, func(string) string { return echo })
+	f := &FrontEnd{SocksAddr: socks}
+	f.SetUsers(map[string]string{"alice": "secret"})
+	return f, users, targets
+}
+
+// Returns the client and the server ends of a connection, the client
+// fails instead of hanging when the server doesn't answer
+func pipe() (net.Conn, net.Conn) {
+	c, s := net.Pipe()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c, s
+}
+
+// Writes b and reads n bytes of the reply
+func exchange(t *testing.T, c net.Conn, b []byte, n int) []byte {
+	t.Helper()
+	go c.Write(b)
+	reply := make([]byte, n)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatalf("reading the reply to %v: %v", b, err)
+	}
+	return reply
+}
+
+func TestSOCKSNoAuthRefused(t *testing.T) {
+	f, _, _ := testFrontEnd(t)
+	c, s := pipe()
+	defer c.Close()
+	go f.handleSOCKS(s)
+	if reply := exchange(t, c, []byte{5, 1, 0}, 2); !bytes.Equal(reply, []byte{5, 0xff}) {
+		t.Errorf("method reply %v, want no acceptable method", reply)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection left open: %v", err)
+	}
+}
+
+func TestSOCKSAuthFailed(t *testing.T) {
+	f, _, _ := testFrontEnd(t)
+	c, s := pipe()
+	defer c.Close()
+	go f.handleSOCKS(s)
+	if reply := exchange(t, c, []byte{5, 2, 0, 2}, 2); !bytes.Equal(reply, []byte{5, 2}) {
+		t.Fatalf("method reply %v, want username and password", reply)
+	}
+	auth := append(append([]byte{1, 5}, "alice"...), append([]byte{5}, "wrong"...)...)
+	if reply := exchange(t, c, auth, 2); !bytes.Equal(reply, []byte{1, 1}) {
+		t.Errorf("authentication reply %v, want failure", reply)
+	}
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	f, users, targets := testFrontEnd(t)
+	c, s := pipe()
+	defer c.Close()
+	go f.handleSOCKS(s)
+	exchange(t, c, []byte{5, 1, 2}, 2)
+	auth := append(append([]byte{1, 5}, "alice"...), append([]byte{6}, "secret"...)...)
+	if reply := exchange(t, c, auth, 2); !bytes.Equal(reply, []byte{1, 0}) {
+		t.Fatalf("authentication reply %v, want success", reply)
+	}
+	req := append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 1, 187)
+	if reply := exchange(t, c, req, 10); reply[1] != 0 {
+		t.Fatalf("CONNECT reply %v, want success", reply)
+	}
+	if reply := exchange(t, c, []byte("ping"), 4); string(reply) != "ping" {
+		t.Errorf("echoed %q", reply)
+	}
+	if u, target := <-users, <-targets; u != "alice" || target != "example.com:443" {
+		t.Errorf("tor stream of %q to %s, want alice to example.com:443", u, target)
+	}
+}
+
+// Sends a CONNECT request to the front-end and returns the status code and
+// the connection
+func connect(t *testing.T, f *FrontEnd, headers, data string) (int, *bufio.Reader, net.Conn) {
+	t.Helper()
+	c, s := pipe()
+	go f.handleHTTP(s)
+	go io.WriteString(c, "CONNECT example.com:80 HTTP/1.1\r\nHost: example.com:80\r\n"+headers+"\r\n"+data)
+	r := bufio.NewReader(c)
+	rsp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp.StatusCode, r, c
+}
+
+func TestHTTPConnect(t *testing.T) {
+	f, users, _ := testFrontEnd(t)
+	for _, tc := range []struct {
+		name, headers string
+	}{
+		{"no credentials", ""},
+		{"invalid base64", "Proxy-Authorization: Basic !!!\r\n"},
+		{"not basic", "Proxy-Authorization: Bearer " + base64.StdEncoding.EncodeToString([]byte("alice:secret")) + "\r\n"},
+		{"wrong password", "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong")) + "\r\n"},
+	} {
+		code, _, c := connect(t, f, tc.headers, "")
+		c.Close()
+		if code != http.StatusProxyAuthRequired {
+			t.Errorf("%s: status %d, want 407", tc.name, code)
+		}
+	}
+	// the first bytes of the stream are sent with the request
+	auth := "Proxy-Authorization: basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")) + "\r\n"
+	code, r, c := connect(t, f, auth, "hello")
+	defer c.Close()
+	if code != http.StatusOK {
+		t.Fatalf("status %d, want 200", code)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(r, b); err != nil || string(b) != "hello" {
+		t.Errorf("echoed %q, %v", b, err)
+	}
+	if u := <-users; u != "alice" {
+		t.Errorf("tor stream of %q, want alice", u)
+	}
+}
+
+func TestReadSocksReply(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		reply []byte
+		err   string
+	}{
+		{"IPv4", []byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 80}, ""},
+		{"domain", append(append([]byte{5, 0, 0, 3, 11}, "example.com"...), 0, 80), ""},
+		{"IPv6", append(append([]byte{5, 0, 0, 4}, net.IPv6loopback...), 0, 80), ""},
+		{"refused", []byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0}, "socks: connection refused"},
+		{"unknown code", []byte{5, 42, 0, 1, 0, 0, 0, 0, 0, 0}, "socks: reply code 42"},
+		{"version", []byte{4, 0, 0, 1, 0, 0, 0, 0, 0, 0}, "unexpected version 4"},
+		{"address type", []byte{5, 0, 0, 2, 0, 0}, "unexpected address type 2"},
+		{"truncated", []byte{5, 0, 0, 4, 0, 0}, "unexpected EOF"},
+	} {
+		// the stream follows the reply and must not be consumed
+		r := bytes.NewReader(append(tc.reply, "stream"...))
+		err := readSocksReply(r)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: error %v, want %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "stream" {
+			t.Errorf("%s: left %q, want the stream", tc.name, rest)
+		}
+	}
+}
+
+func TestReadProxyUsers(t *testing.T) {
+	for _, tc := range []struct {
+		name, data string
+		want       map[string]string
+		err        string
+	}{
+		{"users", "# proxy users\nalice:secret\n\n  bob:p:w  \n", map[string]string{"alice": "secret", "bob": "p:w"}, ""},
+		{"empty", "# nobody\n", nil, "no user:password line"},
+		{"no password", "alice:secret\nbob\n", nil, ":2: expected a user:password line"},
+		{"empty user", ":secret\n", nil, ":1: expected a user:password line"},
+		{"duplicate", "alice:a\nalice:b\n", nil, ":2: duplicate user alice"},
+	} {
+		f := t.TempDir() + "/users"
+		if err := ioutil.WriteFile(f, []byte(tc.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		users, err := ReadProxyUsers(f)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: error %v, want %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if len(users) != len(tc.want) {
+			t.Errorf("%s: users %v, want %v", tc.name, users, tc.want)
+		}
+		for u, p := range tc.want {
+			if users[u] != p {
+				t.Errorf("%s: users %v, want %v", tc.name, users, tc.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package tor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// isolationFlags maps the isolation properties of the configuration to the
+// torrc listener flags
+var isolationFlags = map[string]string{
+	"client_addr":           "IsolateClientAddr",
+	"client_protocol":       "IsolateClientProtocol",
+	"dest_addr":             "IsolateDestAddr",
+	"dest_port":             "IsolateDestPort",
+	"socks_auth":            "IsolateSOCKSAuth",
+	"keep_alive_socks_auth": "KeepAliveIsolateSOCKSAuth"}
+
+// defaultIsolation are the properties tor isolates by default, they are
+// turned off when they are not listed
+var defaultIsolation = []string{"client_addr", "socks_auth"}
+
+// Returns the torrc listener flags of the isolation properties, e.g.
+// dest_addr becomes IsolateDestAddr and an omitted client_addr becomes
+// NoIsolateClientAddr
+func IsolationFlags(names []string) (string, error) {
+	var flags []string
+	set := map[string]bool{}
+	for _, n := range names {
+		f, ok := isolationFlags[n]
+		if !ok {
+			return "", fmt.Errorf("unknown isolation property %q", n)
+		}
+		flags = append(flags, f)
+		set[n] = true
+	}
+	for _, n := range defaultIsolation {
+		if !set[n] {
+			flags = append(flags, "No"+isolationFlags[n])
+		}
+	}
+	return strings.Join(flags, " "), nil
+}
+
+// IsolatedPort is a TransPort dedicated to a traffic class
+type IsolatedPort struct {
+	Port  int
+	Flags string
+}
@@ -0,0 +1,25 @@
+package tor
+
+import "testing"
+
+func TestIsolationFlags(t *testing.T) {
+	for _, tc := range []struct {
+		names []string
+		want  string
+	}{
+		{nil, "NoIsolateClientAddr NoIsolateSOCKSAuth"},
+		{[]string{"dest_addr", "dest_port"}, "IsolateDestAddr IsolateDestPort NoIsolateClientAddr NoIsolateSOCKSAuth"},
+		{[]string{"socks_auth", "keep_alive_socks_auth"}, "IsolateSOCKSAuth KeepAliveIsolateSOCKSAuth NoIsolateClientAddr"},
+		{[]string{"client_addr", "socks_auth"}, "IsolateClientAddr IsolateSOCKSAuth"},
+	} {
+		flags, err := IsolationFlags(tc.names)
+		if err != nil {
+			t.Errorf("%v: %v", tc.names, err)
+		} else if flags != tc.want {
+			t.Errorf("%v: flags %q, want %q", tc.names, flags, tc.want)
+		}
+	}
+	if _, err := IsolationFlags([]string{"dest_host"}); err == nil {
+		t.Error("unknown property accepted")
+	}
+}
@@ -0,0 +1,354 @@
+package tor
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// OnionDir contains the HiddenServiceDir of the persistent onion
+	// services, it is kept when the hidemego data directory is removed
+	OnionDir = path.Join(HidemegoLib, "onion")
+	// onionPortsFile lists the ports of a persistent onion service in its
+	// HiddenServiceDir, tor ignores it
+	onionPortsFile = "hidemego.ports"
+	onionNameRgx   = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+	// onionKeyHeader starts the hs_ed25519_secret_key files written by tor
+	onionKeyHeader = []byte("== ed25519v1-secret: type0 ==\x00\x00\x00")
+)
+
+// OnionPort maps a virtual port of an onion service to a local target
+type OnionPort struct {
+	Virtual int
+	// Target is a port, an address with a port or a unix socket as
+	// unix:/path, empty for the virtual port on 127.0.0.1
+	Target string
+}
+
+// Parses a port written as virtual[:target], e.g. 80:127.0.0.1:8080
+func ParseOnionPort(s string) (OnionPort, error) {
+	var p OnionPort
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	v, err := strconv.Atoi(parts[0])
+	if err != nil || v < 1 || v > 65535 {
+		return p, fmt.Errorf("invalid onion port %q", s)
+	}
+	p.Virtual = v
+	if len(parts) == 1 {
+		return p, nil
+	}
+	p.Target = parts[1]
+	switch {
+	case strings.HasPrefix(p.Target, "unix:") && len(p.Target) > len("unix:"):
+	case validPort(p.Target):
+	default:
+		host, port, err := net.SplitHostPort(p.Target)
+		if err != nil || net.ParseIP(host) == nil || !validPort(port) {
+			return p, fmt.Errorf("invalid onion port target %q", p.Target)
+		}
+	}
+	return p, nil
+}
+
+func validPort(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n > 0 && n < 65536
+}
+
+// Returns the port as accepted by ParseOnionPort
+func (p OnionPort) String() string {
+	if p.Target == "" {
+		return strconv.Itoa(p.Virtual)
+	}
+	return strconv.Itoa(p.Virtual) + ":" + p.Target
+}
+
+// Returns the port as the value of HiddenServicePort
+func (p OnionPort) TorRC() string {
+	if p.Target == "" {
+		return strconv.Itoa(p.Virtual)
+	}
+	return strconv.Itoa(p.Virtual) + " " + p.Target
+}
+
+// Onion is an onion service published by tor
+type Onion struct {
+	// Name is the name of a persistent service, empty for the ephemeral
+	// ones
+	Name string
+	// ServiceID is the address without .onion, empty until tor publishes
+	// a new persistent service
+	ServiceID string
+	Ports     []OnionPort
+	// ClientAuth are the base32 x25519 public keys of the authorized
+	// clients, anyone can connect when it is empty
+	ClientAuth []string
+}
+
+// Returns the HiddenServiceDir of a persistent service
+func (o Onion) Dir() string {
+	return path.Join(OnionDir, o.Name)
+}
+
+// Returns the .onion address, empty when it is not known yet
+func (o Onion) Address() string {
+	if o.ServiceID == "" {
+		return ""
+	}
+	return o.ServiceID + ".onion"
+}
+
+// Validates the name, the ports and the client keys of the service
+func (o Onion) Validate() error {
+	if o.Name != "" && !onionNameRgx.MatchString(o.Name) {
+		return fmt.Errorf("invalid onion service name %q, use lower case letters, digits, - and _", o.Name)
+	}
+	if len(o.Ports) == 0 {
+		return fmt.Errorf("the onion service has no ports")
+	}
+	for _, k := range o.ClientAuth {
+		if b, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(k)); err != nil || len(b) != 32 {
+			return fmt.Errorf("invalid client authorization key %q, expected a base32 x25519 public key", k)
+		}
+	}
+	return nil
+}
+
+// Lists the persistent onion services
+func Onions() ([]Onion, error) {
+	entries, err := ioutil.ReadDir(OnionDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var onions []Onion
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		o, err := ReadOnion(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		onions = append(onions, o)
+	}
+	return onions, nil
+}
+
+// Reads the persistent onion service name
+func ReadOnion(name string) (Onion, error) {
+	o := Onion{Name: name}
+	b, err := ioutil.ReadFile(path.Join(o.Dir(), onionPortsFile))
+	if err != nil {
+		return o, fmt.Errorf("onion service %s: %v", name, err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		p, err := ParseOnionPort(line)
+		if err != nil {
+			return o, fmt.Errorf("onion service %s: %v", name, err)
+		}
+		o.Ports = append(o.Ports, p)
+	}
+	if b, err := ioutil.ReadFile(path.Join(o.Dir(), "hostname")); err == nil {
+		o.ServiceID = strings.TrimSuffix(strings.TrimSpace(string(b)), ".onion")
+	}
+	clients, _ := ioutil.ReadDir(path.Join(o.Dir(), "authorized_clients"))
+	for _, c := range clients {
+		b, err := ioutil.ReadFile(path.Join(o.Dir(), "authorized_clients", c.Name()))
+		if err != nil {
+			return o, err
+		}
+		if f := strings.Split(strings.TrimSpace(string(b)), ":"); len(f) == 3 {
+			o.ClientAuth = append(o.ClientAuth, f[2])
+		}
+	}
+	return o, nil
+}
+
+// Creates the HiddenServiceDir of a persistent service owned by the tor
+// user, key is the 64 bytes ed25519 secret key to import. When key is nil
+// a new key is generated and the address of the service is known at once.
+func CreateOnion(o Onion, key []byte) (Onion, error) {
+	if key != nil {
+		return createOnion(o, key, nil)
+	}
+	secret, public, err := GenerateOnionKey()
+	if err != nil {
+		return o, err
+	}
+	return createOnion(o, secret, public)
+}
+
+// Creates the HiddenServiceDir with the secret key and, when it is not nil,
+// the public key and the hostname
+func createOnion(o Onion, secret, public []byte) (Onion, error) {
+	if err := o.Validate(); err != nil {
+		return o, err
+	}
+	if o.Name == "" {
+		return o, fmt.Errorf("a persistent onion service needs a name")
+	}
+	if _, err := os.Stat(o.Dir()); err == nil {
+		return o, fmt.Errorf("the onion service %s already exists", o.Name)
+	}
+	if err := os.MkdirAll(o.Dir(), 0700); err != nil {
+		return o, err
+	}
+	var ports bytes.Buffer
+	for _, p := range o.Ports {
+		fmt.Fprintln(&ports, p)
+	}
+	err := ioutil.WriteFile(path.Join(o.Dir(), onionPortsFile), ports.Bytes(), 0600)
+	if err == nil {
+		err = writeOnionKeys(o.Dir(), secret, public)
+	}
+	if err == nil && len(o.ClientAuth) > 0 {
+		err = os.Mkdir(path.Join(o.Dir(), "authorized_clients"), 0700)
+	}
+	for i, k := range o.ClientAuth {
+		if err != nil {
+			break
+		}
+		f := path.Join(o.Dir(), "authorized_clients", fmt.Sprintf("client%d.auth", i+1))
+		err = ioutil.WriteFile(f, []byte("descriptor:x25519:"+strings.ToUpper(k)+"\n"), 0600)
+	}
+	if err == nil {
+		err = ChangeDirOwner(OnionDir)
+	}
+	if err != nil {
+		os.RemoveAll(o.Dir())
+		return o, err
+	}
+	if public != nil {
+		o.ServiceID = OnionServiceID(public)
+	}
+	return o, nil
+}
+
+// Removes the persistent service name and its keys
+func RemoveOnion(name string) error {
+	o := Onion{Name: name}
+	if !onionNameRgx.MatchString(name) {
+		return fmt.Errorf("invalid onion service name %q", name)
+	}
+	if _, err := os.Stat(o.Dir()); err != nil {
+		return fmt.Errorf("no onion service named %s", name)
+	}
+	return os.RemoveAll(o.Dir())
+}
+
+// Reads an ed25519 onion service secret key, either a hs_ed25519_secret_key
+// file written by tor or the ED25519-V3:<base64> key of ADD_ONION
+func ReadOnionKey(file string) ([]byte, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(b, onionKeyHeader) {
+		if len(b) != len(onionKeyHeader)+64 {
+			return nil, fmt.Errorf("%s: invalid ed25519 secret key", file)
+		}
+		return b[len(onionKeyHeader):], nil
+	}
+	s := strings.TrimPrefix(strings.TrimSpace(string(b)), "ED25519-V3:")
+	key, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(key) != 64 {
+		return nil, fmt.Errorf("%s: not an ed25519 onion service secret key", file)
+	}
+	return key, nil
+}
+
+// Writes the ed25519 secret key in the hs_ed25519_secret_key format of tor
+func WriteOnionKey(file string, key []byte) error {
+	if len(key) != 64 {
+		return fmt.Errorf("invalid ed25519 secret key length %d", len(key))
+	}
+	return ioutil.WriteFile(file, append(append([]byte{}, onionKeyHeader...), key...), 0600)
+}
+
+// Publishes an ephemeral onion service detached from the control
+// connection, it is removed when tor stops. key is the 64 bytes ed25519
+// secret key, nil to generate one. The secret key is returned only when
+// keep is true, otherwise tor discards it.
+func (c *Control) AddOnion(o Onion, key []byte, keep bool) (Onion, []byte, error) {
+	if err := o.Validate(); err != nil {
+		return o, nil, err
+	}
+	spec := "NEW:ED25519-V3"
+	if key != nil {
+		if len(key) != 64 {
+			return o, nil, fmt.Errorf("invalid ed25519 secret key length %d", len(key))
+		}
+		spec = "ED25519-V3:" + base64.StdEncoding.EncodeToString(key)
+	}
+	flags := []string{"Detach"}
+	if !keep && key == nil {
+		flags = append(flags, "DiscardPK")
+	}
+	if len(o.ClientAuth) > 0 {
+		flags = append(flags, "V3Auth")
+	}
+	cmd := "ADD_ONION " + spec + " Flags=" + strings.Join(flags, ",")
+	for _, p := range o.Ports {
+		cmd += " Port=" + strings.Replace(p.TorRC(), " ", ",", 1)
+	}
+	for _, k := range o.ClientAuth {
+		cmd += " ClientAuthV3=" + strings.ToUpper(k)
+	}
+	r, err := c.Command("%s", cmd)
+	if err != nil {
+		return o, nil, err
+	}
+	for _, line := range r.Lines {
+		switch {
+		case strings.HasPrefix(line, "ServiceID="):
+			o.ServiceID = strings.TrimPrefix(line, "ServiceID=")
+		case strings.HasPrefix(line, "PrivateKey=ED25519-V3:"):
+			if key, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(strings.TrimPrefix(line, "PrivateKey=ED25519-V3:"), "=")); err != nil {
+				return o, nil, fmt.Errorf("invalid private key from tor: %v", err)
+			}
+		}
+	}
+	if !keep {
+		key = nil
+	}
+	return o, key, nil
+}
+
+// Removes the ephemeral onion service with the given service ID
+func (c *Control) DelOnion(id string) error {
+	id = strings.TrimSuffix(id, ".onion")
+	if _, err := OnionPublicKey(id); err != nil {
+		return err
+	}
+	_, err := c.Command("DEL_ONION %s", id)
+	return err
+}
+
+// Lists the service IDs of the ephemeral onion services detached from
+// their control connection
+func (c *Control) EphemeralOnions() ([]string, error) {
+	info, err := c.GetInfo("onions/detached")
+	if err != nil {
+		// tor answers with an error when there are none
+		if strings.Contains(err.Error(), "No onion services") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return strings.Fields(info["onions/detached"]), nil
+}
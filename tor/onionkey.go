@@ -0,0 +1,214 @@
+package tor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+var (
+	// onionPublicKeyHeader starts the hs_ed25519_public_key files
+	onionPublicKeyHeader = []byte("== ed25519v1-public: type0 ==\x00\x00\x00")
+	// onionBackupMagic starts the encrypted onion service backups
+	onionBackupMagic = []byte("HMONION1")
+	// BackupIterations is the PBKDF2 work factor of the backup passphrase
+	BackupIterations = 600000
+)
+
+// Generates a v3 onion service key, the secret key is the 64 bytes
+// expanded ed25519 key stored by tor
+func GenerateOnionKey() (secret, public []byte, err error) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, nil, err
+	}
+	public = ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	h := sha512.Sum512(seed)
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return h[:], public, nil
+}
+
+// Returns the service ID of the v3 onion service with the ed25519 public
+// key, the address without .onion
+func OnionServiceID(public []byte) string {
+	const version = 3
+	sum := sha3Sum256(append(append([]byte(".onion checksum"), public...), version))
+	id := append(append(append([]byte{}, public...), sum[:2]...), version)
+	return strings.ToLower(base32.StdEncoding.EncodeToString(id))
+}
+
+// Returns the public key of a v3 service ID, the checksum and the version
+// are verified
+func OnionPublicKey(id string) ([]byte, error) {
+	id = strings.TrimSuffix(id, ".onion")
+	b, err := base32.StdEncoding.DecodeString(strings.ToUpper(id))
+	if err != nil || len(b) != 35 || b[34] != 3 {
+		return nil, fmt.Errorf("%s is not a v3 onion address", id)
+	}
+	if OnionServiceID(b[:32]) != id {
+		return nil, fmt.Errorf("%s has an invalid checksum", id)
+	}
+	return b[:32], nil
+}
+
+// Writes the key files and the hostname of a v3 service to dir as tor does
+func writeOnionKeys(dir string, secret, public []byte) error {
+	if err := WriteOnionKey(path.Join(dir, "hs_ed25519_secret_key"), secret); err != nil {
+		return err
+	}
+	if public == nil {
+		// tor derives the public key and the hostname
+		return nil
+	}
+	pub := append(append([]byte{}, onionPublicKeyHeader...), public...)
+	if err := ioutil.WriteFile(path.Join(dir, "hs_ed25519_public_key"), pub, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, "hostname"), []byte(OnionServiceID(public)+".onion\n"), 0600)
+}
+
+// Reads the public key tor wrote to the HiddenServiceDir of a persistent
+// service
+func readOnionPublicKey(dir string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path.Join(dir, "hs_ed25519_public_key"))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, onionPublicKeyHeader) || len(b) != len(onionPublicKeyHeader)+32 {
+		return nil, fmt.Errorf("%s: invalid ed25519 public key", dir)
+	}
+	return b[len(onionPublicKeyHeader):], nil
+}
+
+// onionBackup is the encrypted content of an onion service backup
+type onionBackup struct {
+	Name       string   `json:"name"`
+	Ports      []string `json:"ports"`
+	SecretKey  []byte   `json:"secret_key"`
+	PublicKey  []byte   `json:"public_key,omitempty"`
+	ClientAuth []string `json:"client_auth,omitempty"`
+}
+
+// Encrypts the keys, the ports and the authorized clients of the persistent
+// service name with passphrase, using PBKDF2-SHA256 and AES-256-GCM
+func BackupOnion(name string, passphrase []byte) ([]byte, error) {
+	o, err := ReadOnion(name)
+	if err != nil {
+		return nil, err
+	}
+	b := onionBackup{Name: o.Name, ClientAuth: o.ClientAuth}
+	for _, p := range o.Ports {
+		b.Ports = append(b.Ports, p.String())
+	}
+	if b.SecretKey, err = ReadOnionKey(path.Join(o.Dir(), "hs_ed25519_secret_key")); err != nil {
+		return nil, err
+	}
+	if pub, err := readOnionPublicKey(o.Dir()); err == nil {
+		b.PublicKey = pub
+	}
+	plain, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := append(append(append([]byte{}, onionBackupMagic...), salt...), nonce...)
+	return gcm.Seal(header, nonce, plain, header[:len(onionBackupMagic)+len(salt)]), nil
+}
+
+// Decrypts a backup written by BackupOnion and creates the persistent
+// service, named name or as the backed up service when name is empty
+func RestoreOnion(data, passphrase []byte, name string) (Onion, error) {
+	var o Onion
+	if !bytes.HasPrefix(data, onionBackupMagic) || len(data) < len(onionBackupMagic)+16+12 {
+		return o, fmt.Errorf("not a hidemego onion service backup")
+	}
+	salt := data[len(onionBackupMagic) : len(onionBackupMagic)+16]
+	gcm, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return o, err
+	}
+	ad := data[:len(onionBackupMagic)+len(salt)]
+	nonce := data[len(ad) : len(ad)+gcm.NonceSize()]
+	plain, err := gcm.Open(nil, nonce, data[len(ad)+len(nonce):], ad)
+	if err != nil {
+		return o, fmt.Errorf("wrong passphrase or corrupted backup")
+	}
+	var b onionBackup
+	if err := json.Unmarshal(plain, &b); err != nil {
+		return o, fmt.Errorf("invalid backup: %v", err)
+	}
+	if len(b.SecretKey) != 64 || (b.PublicKey != nil && len(b.PublicKey) != 32) {
+		return o, fmt.Errorf("invalid backup: bad key length")
+	}
+	o = Onion{Name: b.Name, ClientAuth: b.ClientAuth}
+	if name != "" {
+		o.Name = name
+	}
+	for _, s := range b.Ports {
+		p, err := ParseOnionPort(s)
+		if err != nil {
+			return o, fmt.Errorf("invalid backup: %v", err)
+		}
+		o.Ports = append(o.Ports, p)
+	}
+	return createOnion(o, b.SecretKey, b.PublicKey)
+}
+
+func backupCipher(passphrase, salt []byte) (cipher.AEAD, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	block, err := aes.NewCipher(pbkdf2SHA256(passphrase, salt, BackupIterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PBKDF2 with HMAC-SHA256 as defined by RFC 8018
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var dk []byte
+	for block := uint32(1); len(dk) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
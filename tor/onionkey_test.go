@@ -0,0 +1,136 @@
+package tor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// FIPS 202 examples, the last message is longer than the 136 bytes rate
+func TestSHA3Sum256(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "a7ffc6f8bf1ed76651c14756a061d662f580ff4de43b49fa82d80a4b80f8434a"},
+		{"abc", []byte("abc"), "3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532"},
+		{"200 bytes of a3", bytes.Repeat([]byte{0xa3}, 200), "79f38adec5c20307a98ef76e8324afbfd46cfd81b22e3973c65fa1bd9de31787"},
+	} {
+		if sum := sha3Sum256(tc.data); hex.EncodeToString(sum[:]) != tc.want {
+			t.Errorf("%s: %x, want %s", tc.name, sum, tc.want)
+		}
+	}
+}
+
+// RFC 7914 section 11
+func TestPBKDF2SHA256(t *testing.T) {
+	for _, tc := range []struct {
+		password, salt string
+		iter           int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+			"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+			"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	} {
+		dk := pbkdf2SHA256([]byte(tc.password), []byte(tc.salt), tc.iter, 64)
+		if hex.EncodeToString(dk) != tc.want {
+			t.Errorf("%s/%s/%d: %x, want %s", tc.password, tc.salt, tc.iter, dk, tc.want)
+		}
+	}
+}
+
+// The published addresses of the Tor Project and DuckDuckGo
+func TestOnionServiceID(t *testing.T) {
+	for _, tc := range []struct {
+		id, public string
+	}{
+		{"2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid", "d1b38b83a83b3ed918c5bb69dd444ad56bc8d5835a914de73447474e5f02591b"},
+		{"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad", "1d04a1d04a338c6e6ae970bfabee49049d6702250984ca950c01673f4ec034ad"},
+	} {
+		public, _ := hex.DecodeString(tc.public)
+		if id := OnionServiceID(public); id != tc.id {
+			t.Errorf("service ID %s, want %s", id, tc.id)
+		}
+		key, err := OnionPublicKey(tc.id + ".onion")
+		if err != nil {
+			t.Errorf("%s: %v", tc.id, err)
+		} else if !bytes.Equal(key, public) {
+			t.Errorf("%s: public key %x, want %s", tc.id, key, tc.public)
+		}
+	}
+	for _, id := range []string{
+		// a changed character breaks the checksum
+		"2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wib",
+		"2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wi",
+		"expyuzz4wqqyqhjn",
+	} {
+		if _, err := OnionPublicKey(id); err == nil {
+			t.Errorf("%s accepted", id)
+		}
+	}
+}
+
+func TestBackupRestoreOnion(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	// the restored service is chowned to the tor user of defaults-torrc
+	if _, err := user.LookupGroup(u.Username); err != nil {
+		t.Skip(err)
+	}
+	defer func(dir, rc string, iter int) { OnionDir, DefaultTorRC, BackupIterations = dir, rc, iter }(OnionDir, DefaultTorRC, BackupIterations)
+	OnionDir = filepath.Join(t.TempDir(), "onion")
+	DefaultTorRC = filepath.Join(t.TempDir(), "defaults-torrc")
+	BackupIterations = 1000
+	if err := ioutil.WriteFile(DefaultTorRC, []byte("User "+u.Username+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	client := strings.Repeat("A", 52)
+	o, err := CreateOnion(Onion{Name: "web", Ports: []OnionPort{{Virtual: 80}, {Virtual: 443, Target: "127.0.0.1:8443"}},
+		ClientAuth: []string{client}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := BackupOnion("web", []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreOnion(data, []byte("wrong horse"), "copy"); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("wrong passphrase: error %v", err)
+	}
+	if _, err := RestoreOnion(data, []byte("correct horse"), ""); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("restore over the backed up service: error %v", err)
+	}
+	r, err := RestoreOnion(data, []byte("correct horse"), "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ServiceID != o.ServiceID || !reflect.DeepEqual(r.Ports, o.Ports) || !reflect.DeepEqual(r.ClientAuth, o.ClientAuth) {
+		t.Errorf("restored %+v, backed up %+v", r, o)
+	}
+	back, err := ReadOnion("copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.ServiceID != o.ServiceID || !reflect.DeepEqual(back.Ports, o.Ports) {
+		t.Errorf("read back %+v, backed up %+v", back, o)
+	}
+	secret, _ := ReadOnionKey(filepath.Join(o.Dir(), "hs_ed25519_secret_key"))
+	restored, _ := ReadOnionKey(filepath.Join(r.Dir(), "hs_ed25519_secret_key"))
+	if secret == nil || !bytes.Equal(secret, restored) {
+		t.Error("the restored secret key differs")
+	}
+	data[len(data)-1] ^= 1
+	if _, err := RestoreOnion(data, []byte("correct horse"), "corrupted"); err == nil {
+		t.Error("corrupted backup restored")
+	}
+}
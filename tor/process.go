@@ -0,0 +1,133 @@
+package tor
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/multiversecoder/hidemego/systemd"
+	"github.com/multiversecoder/hidemego/tools"
+)
+
+// Returns the PID of the main process of ServiceName as reported by
+// systemd, so that the system tor is never targeted
+func MainPID() (int, error) {
+	pid, err := systemd.System.MainPID(ServiceName)
+	if err != nil {
+		return 0, fmt.Errorf("can't read the %s main PID: %v", ServiceName, err)
+	}
+	if pid == 0 {
+		return 0, fmt.Errorf("%s is not running", ServiceName)
+	}
+	return pid, nil
+}
+
+// Sends sig to the main process of ServiceName
+func Kill(sig syscall.Signal) error {
+	pid, err := MainPID()
+	if err != nil {
+		return err
+	}
+	// the PID may have been reused after the service stopped
+	comm, err := ioutil.ReadFile(path.Join("/proc", strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return err
+	}
+	if name := strings.TrimSpace(string(comm)); name != "tor" {
+		return fmt.Errorf("the %s main process %d is %s, not tor", ServiceName, pid, name)
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// Makes tor reload the torrc and open new circuits sending HUP to the main
+// process of ServiceName
+func Reload() error {
+	return Kill(syscall.SIGHUP)
+}
+
+// Instance is a tor process run by hidemego outside systemd
+type Instance struct {
+	cmd  *exec.Cmd
+	done chan error
+	mu   sync.Mutex
+	// last are the last messages logged by tor
+	last []string
+}
+
+// Starts tor with torrc and waits until it is bootstrapped, progress is
+// called with the bootstrap messages
+func StartInstance(torrc string, timeout time.Duration, progress func(string)) (*Instance, error) {
+	bin, err := tools.Which("tor")
+	if err != nil || bin == "" {
+		return nil, fmt.Errorf("can't find the tor binary")
+	}
+	i := &Instance{
+		cmd:  exec.Command(bin, "--defaults-torrc", "/dev/null", "-f", torrc, "--RunAsDaemon", "0"),
+		done: make(chan error, 1)}
+	out, err := i.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	i.cmd.Stderr = i.cmd.Stdout
+	if err := i.cmd.Start(); err != nil {
+		return nil, err
+	}
+	ready := make(chan struct{}, 1)
+	go func() {
+		s := bufio.NewScanner(out)
+		for s.Scan() {
+			line := s.Text()
+			i.mu.Lock()
+			if i.last = append(i.last, line); len(i.last) > 10 {
+				i.last = i.last[1:]
+			}
+			i.mu.Unlock()
+			if n := strings.Index(line, "Bootstrapped "); n >= 0 {
+				if progress != nil {
+					progress(line[n:])
+				}
+				if strings.HasPrefix(line[n:], "Bootstrapped 100%") {
+					select {
+					case ready <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+		i.done <- i.cmd.Wait()
+	}()
+	select {
+	case <-ready:
+		return i, nil
+	case err := <-i.done:
+		i.done <- err
+		return nil, fmt.Errorf("tor exited: %v\n%s", err, i.messages())
+	case <-time.After(timeout):
+		i.Stop()
+		return nil, fmt.Errorf("tor not bootstrapped in %s\n%s", timeout, i.messages())
+	}
+}
+
+func (i *Instance) messages() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return strings.Join(i.last, "\n")
+}
+
+// Stops tor, killing it when it doesn't exit in 10 seconds
+func (i *Instance) Stop() {
+	i.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-i.done:
+	case <-time.After(10 * time.Second):
+		i.cmd.Process.Kill()
+		<-i.done
+	}
+}
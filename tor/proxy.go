@@ -0,0 +1,110 @@
+package tor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// proxy URL schemes and the related torrc proxy type
+var proxySchemes = map[string]string{
+	"http":   "https",
+	"https":  "https",
+	"socks4": "socks4",
+	"socks5": "socks5"}
+
+// Proxy is the upstream proxy tor connects through
+type Proxy struct {
+	// Type is one of https (HTTP CONNECT), socks4 and socks5
+	Type     string
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+// Parses an upstream proxy URL such as socks5://192.0.2.1:1080 or
+// http://proxy.example.com:3128
+func ParseProxy(raw string) (Proxy, error) {
+	var p Proxy
+	u, err := url.Parse(raw)
+	if err != nil {
+		return p, err
+	}
+	t, ok := proxySchemes[strings.ToLower(u.Scheme)]
+	if !ok {
+		return p, fmt.Errorf("unsupported proxy scheme %q, use http, socks4 or socks5", u.Scheme)
+	}
+	if u.User != nil {
+		return p, fmt.Errorf("credentials must be read from a file, not from the proxy URL")
+	}
+	if u.Path != "" && u.Path != "/" {
+		return p, fmt.Errorf("unexpected path %q in proxy URL", u.Path)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil || port < 1 || port > 65535 {
+		return p, fmt.Errorf("invalid proxy port %q", u.Port())
+	}
+	if u.Hostname() == "" {
+		return p, fmt.Errorf("missing proxy host")
+	}
+	p.Type = t
+	p.Host = u.Hostname()
+	p.Port = port
+	return p, nil
+}
+
+// Reads the proxy credentials from the file at f, the file contains a single
+// user:password line
+func (p *Proxy) ReadCredentials(f string) error {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return err
+	}
+	kv := strings.SplitN(strings.TrimSpace(string(b)), ":", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("%s: expected a user:password line", f)
+	}
+	switch p.Type {
+	case "socks4":
+		return fmt.Errorf("socks4 proxies don't support authentication")
+	case "socks5":
+		if len(kv[0]) > 255 || len(kv[1]) > 255 || kv[1] == "" {
+			return fmt.Errorf("%s: socks5 user and password must be 1 to 255 characters long", f)
+		}
+	}
+	if strings.ContainsAny(kv[0]+kv[1], "\n\r\" ") {
+		return fmt.Errorf("%s: credentials can't contain spaces or quotes", f)
+	}
+	p.Username, p.Password = kv[0], kv[1]
+	return nil
+}
+
+// Resolves the proxy host to an IPv4 address, the firewall allows tor to
+// reach only that address
+func (p *Proxy) Resolve() error {
+	if ip := net.ParseIP(p.Host); ip != nil {
+		if ip.To4() == nil {
+			return fmt.Errorf("IPv6 proxies are not supported")
+		}
+		return nil
+	}
+	addrs, err := net.LookupHost(p.Host)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+			p.Host = a
+			return nil
+		}
+	}
+	return fmt.Errorf("no IPv4 address found for %s", p.Host)
+}
+
+func (p Proxy) Addr() string {
+	return net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+}
@@ -0,0 +1,164 @@
+package tor
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// socksReplies are the messages of the SOCKS5 reply codes
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported"}
+
+// SocksError is a SOCKS5 request refused by tor
+type SocksError struct {
+	Code byte
+}
+
+func (e SocksError) Error() string {
+	if msg, ok := socksReplies[e.Code]; ok {
+		return "socks: " + msg
+	}
+	return fmt.Sprintf("socks: reply code %d", e.Code)
+}
+
+// Connects to target through the tor SocksPort at socks. The username and
+// the password, when given, are sent to tor which isolates the streams by
+// credentials (IsolateSOCKSAuth).
+func DialSOCKS(socks, user, pass, target string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	if len(host) > 255 || len(user) > 255 || len(pass) > 255 {
+		return nil, fmt.Errorf("socks: host or credentials longer than 255 bytes")
+	}
+	c, err := net.DialTimeout("tcp", socks, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	if err := socksConnect(c, user, pass, host, uint16(p)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func socksConnect(c net.Conn, user, pass, host string, port uint16) error {
+	method := byte(0)
+	if user != "" || pass != "" {
+		method = 2
+	}
+	if _, err := c.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return err
+	}
+	if b[0] != 5 || b[1] != method {
+		return fmt.Errorf("socks: authentication method refused")
+	}
+	if method == 2 {
+		auth := append([]byte{1, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := c.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return fmt.Errorf("socks: authentication failed")
+		}
+	}
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, 1), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 4), ip.To16()...)
+	} else {
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	return readSocksReply(c)
+}
+
+// Reads the reply to a CONNECT request, the bound address is discarded. The
+// reader is not buffered, the data following the reply belongs to the stream.
+func readSocksReply(r io.Reader) error {
+	var h [4]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return err
+	}
+	if h[0] != 5 {
+		return fmt.Errorf("socks: unexpected version %d", h[0])
+	}
+	if h[1] != 0 {
+		return SocksError{Code: h[1]}
+	}
+	var n int
+	switch h[3] {
+	case 1:
+		n = net.IPv4len
+	case 4:
+		n = net.IPv6len
+	case 3:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("socks: unexpected address type %d", h[3])
+	}
+	_, err := io.ReadFull(r, make([]byte, n+2))
+	return err
+}
+
+// Reads the credentials accepted by the local proxies, one user:password
+// line per user, empty lines and lines starting with # are skipped
+func ReadProxyUsers(f string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	users := map[string]string{}
+	for i, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" || len(kv[0]) > 255 || len(kv[1]) > 255 {
+			return nil, fmt.Errorf("%s:%d: expected a user:password line, 1 to 255 characters each", f, i+1)
+		}
+		if _, ok := users[kv[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate user %s", f, i+1, kv[0])
+		}
+		users[kv[0]] = kv[1]
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s: no user:password line", f)
+	}
+	return users, nil
+}
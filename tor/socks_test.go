@@ -0,0 +1,100 @@
+package tor
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// Starts a SOCKS5 server accepting username and password authentication,
+// like the tor SocksAuthPort. It connects to the requested target, or to
+// the address returned by route when not empty, and sends the users and the
+// targets of the requests on users and targets.
+func fakeSocks(t *testing.T, route func(target string) string) (addr string, users, targets chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	users, targets = make(chan string, 16), make(chan string, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				user, target, err := socksServe(c)
+				if err != nil {
+					return
+				}
+				users <- user
+				targets <- target
+				if r := route(target); r != "" {
+					target = r
+				}
+				up, err := net.Dial("tcp", target)
+				if err != nil {
+					c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer up.Close()
+				c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+				go io.Copy(up, c)
+				io.Copy(c, up)
+			}()
+		}
+	}()
+	return l.Addr().String(), users, targets
+}
+
+// Reads the greeting, the credentials and the CONNECT request of a client
+func socksServe(c net.Conn) (user, target string, err error) {
+	b := make([]byte, 262)
+	if _, err = io.ReadFull(c, b[:2]); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(c, b[:b[1]]); err != nil {
+		return
+	}
+	c.Write([]byte{5, 2})
+	if _, err = io.ReadFull(c, b[:2]); err != nil {
+		return
+	}
+	n := int(b[1])
+	if _, err = io.ReadFull(c, b[:n+1]); err != nil {
+		return
+	}
+	user = string(b[:n])
+	if _, err = io.ReadFull(c, b[:b[n]]); err != nil {
+		return
+	}
+	c.Write([]byte{1, 0})
+	if _, err = io.ReadFull(c, b[:4]); err != nil {
+		return
+	}
+	var host string
+	switch b[3] {
+	case 1:
+		_, err = io.ReadFull(c, b[:4])
+		host = net.IP(b[:4]).String()
+	case 4:
+		_, err = io.ReadFull(c, b[:16])
+		host = net.IP(b[:16]).String()
+	default:
+		if _, err = io.ReadFull(c, b[:1]); err == nil {
+			n := int(b[0])
+			_, err = io.ReadFull(c, b[:n])
+			host = string(b[:n])
+		}
+	}
+	if err != nil {
+		return
+	}
+	if _, err = io.ReadFull(c, b[:2]); err != nil {
+		return
+	}
+	return user, net.JoinHostPort(host, strconv.Itoa(int(b[0])<<8|int(b[1]))), nil
+}
@@ -0,0 +1,172 @@
+package tor
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClockSample is the offset of the local clock from the clock of a web
+// server, positive when the local clock is behind
+type ClockSample struct {
+	Source string
+	Offset time.Duration
+	Err    error
+}
+
+// ClockReader reads the Date header of web servers through a tor
+// SocksPort, like sdwdate. Every source is read with its own credentials
+// so that, on a port with IsolateSOCKSAuth, each one gets its own circuit
+// and a single exit can't shift the clock.
+type ClockReader struct {
+	// SocksAddr is the address of the tor SocksPort
+	SocksAddr string
+	// Timeout bounds the whole request to a source
+	Timeout time.Duration
+	// VerifyAt is the time the certificates are verified at, the local
+	// clock when zero. A wrong clock makes valid certificates look expired.
+	VerifyAt time.Time
+}
+
+// Checks that source is an https URL or an http onion URL, an onion
+// service authenticates its server without certificates
+func ParseClockSource(source string) (*url.URL, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%q has no host", source)
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !strings.HasSuffix(u.Hostname(), ".onion") {
+			return nil, fmt.Errorf("%q: http is accepted only for onion services", source)
+		}
+	default:
+		return nil, fmt.Errorf("%q: unsupported scheme %q", source, u.Scheme)
+	}
+	return u, nil
+}
+
+// Returns the offset of the local clock from the clock of source. The Date
+// header has a resolution of one second and is sent about half a round
+// trip before it is received, both are compensated.
+func (r ClockReader) Offset(source string) (time.Duration, error) {
+	u, err := ParseClockSource(source)
+	if err != nil {
+		return 0, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	user := make([]byte, 8)
+	if _, err := rand.Read(user); err != nil {
+		return 0, err
+	}
+	c, err := DialSOCKS(r.SocksAddr, "hidemego-time-"+hex.EncodeToString(user), "x",
+		net.JoinHostPort(u.Hostname(), port), r.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(r.Timeout))
+	if u.Scheme == "https" {
+		cfg := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if !r.VerifyAt.IsZero() {
+			at := r.VerifyAt
+			cfg.Time = func() time.Time { return at }
+		}
+		tc := tls.Client(c, cfg)
+		if err := tc.Handshake(); err != nil {
+			return 0, err
+		}
+		c = tc
+	}
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Close = true
+	sent := time.Now()
+	if err := req.Write(c); err != nil {
+		return 0, err
+	}
+	rsp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		return 0, err
+	}
+	rsp.Body.Close()
+	received := time.Now()
+	date, err := http.ParseTime(rsp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid Date header %q", rsp.Header.Get("Date"))
+	}
+	rtt := received.Sub(sent)
+	return date.Add(500*time.Millisecond + rtt/2).Sub(received), nil
+}
+
+// Reads the offsets of the sources concurrently, in the order of sources
+func (r ClockReader) Sample(sources []string) []ClockSample {
+	samples := make([]ClockSample, len(sources))
+	var wg sync.WaitGroup
+	for i, s := range sources {
+		wg.Add(1)
+		go func(i int, s string) {
+			defer wg.Done()
+			off, err := r.Offset(s)
+			samples[i] = ClockSample{Source: s, Offset: off, Err: err}
+		}(i, s)
+	}
+	wg.Wait()
+	return samples
+}
+
+// Returns the median of the offsets, the sources lying about the time are
+// ignored as long as they are less than half
+func MedianOffset(offsets []time.Duration) time.Duration {
+	if len(offsets) == 0 {
+		return 0
+	}
+	s := append([]time.Duration(nil), offsets...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+// Returns the valid-after and valid-until times of the consensus used by
+// tor, the network time is between them unless tor failed to fetch a
+// newer consensus
+func (c *Control) ConsensusValidity() (time.Time, time.Time, error) {
+	info, err := c.GetInfo("consensus/valid-after", "consensus/valid-until")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	const layout = "2006-01-02 15:04:05"
+	after, err := time.Parse(layout, info["consensus/valid-after"])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid consensus valid-after %q", info["consensus/valid-after"])
+	}
+	until, err := time.Parse(layout, info["consensus/valid-until"])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid consensus valid-until %q", info["consensus/valid-until"])
+	}
+	return after, until, nil
+}
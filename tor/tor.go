@@ -9,8 +9,8 @@ import (
 	"path"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/multiversecoder/hidemego/systemd"
 	"github.com/multiversecoder/hidemego/tools"
 )
 
@@ -36,85 +36,29 @@ func Usr() (string, error) {
 }
 
 func Restart(reload ...bool) error {
-	var (
-		relo   bool
-		action string
-	)
-	if len(reload) > 0 {
-		relo = reload[0]
-	}
-	switch relo {
-	case true:
-		action = "reload"
-	case false:
-		action = "restart"
-	}
-	return exec.Command("systemctl", action, ServiceName).Run()
-}
-
-func Stop() error {
-	return exec.Command("systemctl", "stop", ServiceName).Run()
-}
-
-func ChangeControlIdentity(ip string, tpass string, tport int) error {
-	m := make(map[string]interface{})
-	m["TorPassword"] = tpass
-	m["TorPort"] = tport
-	tb, err := tools.Read("nymn", m)
-	if err != nil {
-		return err
-	}
-	script, err := tools.TempFile("./nymn.sh", tb.Bytes())
-	if err != nil {
-		return err
-	}
-	defer os.Remove(script)
-	netcat := exec.Command("/bin/bash", script)
-	if err := netcat.Run(); err != nil {
-		return err
-	}
-	return nil
-}
-
-// Change IP Addr sending HUP to tor
-func ChangeHUPIdentity(ip string) error {
-	pid, err := exec.Command("pidof", "tor").Output()
-	if err != nil {
-		return err
-	}
-	hup := exec.Command("kill", "-HUP", strings.TrimSuffix(string(pid), "\n"))
-	if err := hup.Run(); err != nil {
+	if len(reload) > 0 && reload[0] {
+		return Reload()
+	}
+	cursor, _ := systemd.Cursor(ServiceName)
+	if err := systemd.System.Restart(ServiceName); err != nil {
+		// show why tor didn't start
+		if lines, jerr := systemd.Since(ServiceName, cursor); jerr == nil && len(lines) > 0 {
+			if len(lines) > 10 {
+				lines = lines[len(lines)-10:]
+			}
+			return fmt.Errorf("%v\n%s", err, strings.Join(lines, "\n"))
+		}
 		return err
 	}
 	return nil
 }
 
-func ChangeIdentity(tpass string, tport int) (string, error) {
-	var hip string
-	ip, err := tools.GetIPAddress()
-	if err != nil {
-		return "", err
-	}
-	err = ChangeHUPIdentity(ip)
-	if err != nil {
-		return "", err
-	}
-	hip, err = tools.GetIPAddress()
-	if err != nil {
-		return "", err
-	}
-	if ip == hip && tpass != "" {
-		time.Sleep(3 * time.Second)
-		err := ChangeControlIdentity(ip, tpass, tport)
-		if err != nil {
-			return "", err
-		}
-		hip, err = tools.GetIPAddress()
-		if err != nil {
-			return "", err
-		}
+func Stop() error {
+	// nothing to stop when the unit was already removed
+	if s, err := systemd.System.State(ServiceName); err == nil && s.LoadState == "not-found" {
+		return nil
 	}
-	return hip, nil
+	return systemd.System.Stop(ServiceName)
 }
 
 func ID() (int, error) {
@@ -145,34 +89,112 @@ func ChangeDirOwner(dir string) error {
 
 }
 
-func SetTorRC(countries string, torPort, socksDestPort, socksAuthPort, controlPort, dnsPort int, tuser string, tpass ...string) error {
+// RC contains the values used to render hidemego.torrc
+type RC struct {
+	Nodes         NodeSelection
+	TransPort     int
+	SocksDestPort int
+	SocksAuthPort int
+	ControlPort   int
+	DNSPort       int
+	User          string
+	// ControlPassword enables the password authentication of the control
+	// port, the cookie authentication is always enabled
+	ControlPassword string
+	StrictNodes     bool
+	// MaxCircuitDirtiness in seconds, zero keeps the tor default
+	MaxCircuitDirtiness int
+	CacheDNS            bool
+	UseBridges          bool
+	Bridges             []Bridge
+	TransportPlugins    []TransportPlugin
+	// Proxy is the upstream proxy, nil when tor connects directly
+	Proxy *Proxy
+	// ListenAddr is the address of the TransPort and the DNSPort, empty
+	// for 127.0.0.1. Zero SocksDestPort, SocksAuthPort and ControlPort
+	// disable the listeners.
+	ListenAddr string
+	// Gateways are the gateway interface and the container bridges, the
+	// TransPort and the DNSPort listen on their addresses too
+	Gateways []Gateway
+	// Onions are the persistent onion services
+	Onions []Onion
+	// TransFlags, SocksDestFlags and SocksAuthFlags are the isolation
+	// flags of the listeners
+	TransFlags     string
+	SocksDestFlags string
+	SocksAuthFlags string
+	// IsolatedPorts are the TransPorts of the isolation classes
+	IsolatedPorts []IsolatedPort
+}
+
+// Gateway is an interface whose clients are routed through tor
+type Gateway struct {
+	Iface string
+	Addr  string
+	// Container marks the bridge of a container network
+	Container bool
+}
+
+func SetTorRC(rc RC) error {
+	return WriteTorRC(rc, HidemegoTorRC, HidemegoLib)
+}
+
+// Renders the torrc to file with the tor data directory dataDir
+func WriteTorRC(rc RC, file, dataDir string) error {
 	var tb bytes.Buffer
 	var m = make(map[string]interface{})
-	m["TorPort"] = torPort
-	m["Countries"] = countries
-	m["DataDir"] = HidemegoLib
-	if len(tpass) > 0 {
-		m["ControlPort"] = controlPort
-		m["HasTorControl"] = true
-		m["TPass"] = tpass[0]
-	} else {
-		m["ControlPort"] = controlPort
-		m["HasTorControl"] = false
-		m["TPass"] = ""
-	}
-	m["SocksDestPort"] = socksDestPort
-	m["SocksAuthPort"] = socksAuthPort
-	m["DNSPort"] = dnsPort
+	m["TorPort"] = rc.TransPort
+	m["ExcludeNodes"] = rc.Nodes.ExcludeNodes
+	m["ExcludeExitNodes"] = rc.Nodes.ExcludeExitNodes
+	m["EntryNodes"] = rc.Nodes.EntryNodes
+	m["ExitNodes"] = rc.Nodes.ExitNodes
+	m["DataDir"] = dataDir
+	m["ListenAddr"] = rc.ListenAddr
+	m["Gateways"] = rc.Gateways
+	m["User"] = rc.User
+	m["ControlPort"] = rc.ControlPort
+	m["TPass"] = ""
+	if rc.ControlPassword != "" {
+		hash, err := HashControlPassword(rc.ControlPassword)
+		if err != nil {
+			return fmt.Errorf("can't hash the control password: %v", err)
+		}
+		m["TPass"] = hash
+	}
+	m["SocksDestPort"] = rc.SocksDestPort
+	m["SocksAuthPort"] = rc.SocksAuthPort
+	m["DNSPort"] = rc.DNSPort
+	m["StrictNodes"] = rc.StrictNodes
+	m["MaxCircuitDirtiness"] = rc.MaxCircuitDirtiness
+	m["CacheDNS"] = rc.CacheDNS
+	m["UseBridges"] = rc.UseBridges
+	m["Bridges"] = rc.Bridges
+	m["TransportPlugins"] = rc.TransportPlugins
+	m["Proxy"] = rc.Proxy
+	m["Onions"] = rc.Onions
+	m["TransFlags"] = rc.TransFlags
+	m["SocksDestFlags"] = rc.SocksDestFlags
+	m["SocksAuthFlags"] = rc.SocksAuthFlags
+	m["IsolatedPorts"] = rc.IsolatedPorts
 	tb, err := tools.Read("torrc", m)
 	if err != nil {
 		return err
 	}
-	os.Mkdir(HidemegoLib, 0777)
-	chown := exec.Command("chown", tuser+":root", HidemegoLib)
+	os.Mkdir(dataDir, 0777)
+	chown := exec.Command("chown", rc.User+":root", dataDir)
 	if err := chown.Run(); err != nil {
 		return err
 	}
-	return ioutil.WriteFile(HidemegoTorRC, tb.Bytes(), 0644)
+	if rc.Proxy != nil && rc.Proxy.Username != "" {
+		// keep the proxy credentials readable only by root and tor
+		os.Remove(file)
+		if err := ioutil.WriteFile(file, tb.Bytes(), 0640); err != nil {
+			return err
+		}
+		return exec.Command("chown", "root:"+rc.User, file).Run()
+	}
+	return ioutil.WriteFile(file, tb.Bytes(), 0644)
 }
 
 func RemoveTorRc() error {
@@ -182,10 +204,21 @@ func RemoveTorRc() error {
 	return nil
 }
 
+// Removes the hidemego data directory but the persistent onion services
 func RemoveHideMeGoDir() error {
-	if _, err := os.Stat(HidemegoLib); !os.IsNotExist(err) {
-		return os.RemoveAll(HidemegoLib)
+	entries, err := ioutil.ReadDir(HidemegoLib)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if p := path.Join(HidemegoLib, e.Name()); p != OnionDir {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
-
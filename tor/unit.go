@@ -0,0 +1,48 @@
+package tor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/multiversecoder/hidemego/systemd"
+	"github.com/multiversecoder/hidemego/tools"
+)
+
+// UnitFile is the runtime unit of ServiceName installed by hidemego, it takes
+// precedence over the tor@.service template shipped by some distributions
+var UnitFile = path.Join("/", "run", "systemd", "system", ServiceName)
+
+// Installs the hardened unit running tor with HidemegoTorRC
+func InstallUnit() error {
+	bin, err := tools.Which("tor")
+	if err != nil || bin == "" {
+		return fmt.Errorf("can't find the tor binary")
+	}
+	tb, err := tools.Read("torunit", map[string]interface{}{
+		"Tor":     bin,
+		"TorRC":   HidemegoTorRC,
+		"DataDir": HidemegoLib})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(UnitFile), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(UnitFile, tb.Bytes(), 0644); err != nil {
+		return err
+	}
+	return systemd.System.DaemonReload()
+}
+
+// Removes the unit installed by InstallUnit
+func RemoveUnit() error {
+	if _, err := os.Stat(UnitFile); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.Remove(UnitFile); err != nil {
+		return err
+	}
+	return systemd.System.DaemonReload()
+}